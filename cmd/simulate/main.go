@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/server"
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	pb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
+	epb "github.com/slntopp/nocloud-proto/events"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	spb "github.com/slntopp/nocloud-proto/services"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	stpb "github.com/slntopp/nocloud-proto/states"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	planFile     string
+	serviceFile  string
+	addonsFile   string
+	spFile       string
+	ratesFile    string
+	instanceName string
+
+	startDate string
+	months    int
+	step      time.Duration
+	balance   float64
+	verbose   bool
+)
+
+func init() {
+	flag.StringVar(&planFile, "plan", "examples/static_plan.yml", "Billing plan YAML")
+	flag.StringVar(&serviceFile, "service", "examples/service.yml", "Service YAML containing the instance")
+	flag.StringVar(&addonsFile, "addons", "", "Addons YAML (list of addons)")
+	flag.StringVar(&spFile, "sp", "", "Services provider YAML")
+	flag.StringVar(&ratesFile, "rates", "", "Currency rates YAML")
+	flag.StringVar(&instanceName, "instance", "", "Instance title, first instance of the service is used if empty")
+
+	flag.StringVar(&startDate, "start", time.Now().UTC().Format(time.DateOnly), "Simulation start date (YYYY-MM-DD)")
+	flag.IntVar(&months, "months", 1, "Simulated timeline length in months")
+	flag.DurationVar(&step, "step", time.Hour, "Interval between Monitoring ticks")
+	flag.Float64Var(&balance, "balance", 0, "Initial account balance")
+	flag.BoolVar(&verbose, "v", false, "Print driver logs")
+}
+
+type row struct {
+	ts      time.Time
+	kind    string
+	details string
+}
+
+// simulation keeps the state nocloud would persist between Monitoring ticks
+type simulation struct {
+	mu sync.Mutex
+
+	clock *utils.FakeClock
+	rows  []row
+
+	state *stpb.State
+	data  map[string]*structpb.Value
+}
+
+func (sim *simulation) add(kind, details string) {
+	sim.rows = append(sim.rows, row{ts: sim.clock.Now(), kind: kind, details: details})
+}
+
+func (sim *simulation) setup(driver *server.VirtualDriver) {
+	driver.HandlePublishRecords = func(records []*billingpb.Record) {
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		for _, rec := range records {
+			sim.add("record", fmt.Sprintf("product=%s addon=%s resource=%s start=%s end=%s total=%g",
+				rec.GetProduct(), rec.GetAddon(), rec.GetResource(), formatTs(rec.GetStart()), formatTs(rec.GetEnd()), rec.GetTotal()))
+		}
+	}
+	driver.HandlePublishEvent = func(event *epb.Event) {
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		key := event.GetKey()
+		if key == "" {
+			key = event.GetType()
+		}
+		data, _ := json.Marshal((&structpb.Struct{Fields: event.GetData()}).AsMap())
+		sim.add("event", fmt.Sprintf("%s %s", key, data))
+	}
+	driver.HandlePublishSPState = func(*stpb.ObjectState) (int, error) {
+		return 0, nil
+	}
+	driver.HandlePublishInstanceState = func(state *stpb.ObjectState) (int, error) {
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		if sim.state.GetState() != state.GetState().GetState() {
+			sim.add("state", fmt.Sprintf("%s -> %s", sim.state.GetState(), state.GetState().GetState()))
+		}
+		sim.state = state.GetState()
+		return 0, nil
+	}
+	driver.HandlePublishInstanceData = func(data *ipb.ObjectData) (int, error) {
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		sim.data = maps.Clone(data.GetData())
+		return 0, nil
+	}
+	driver.HandleUpdateInstance = func(_ context.Context, inst *ipb.Instance) error {
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		config, _ := json.Marshal((&structpb.Struct{Fields: inst.GetConfig()}).AsMap())
+		sim.add("update", fmt.Sprintf("product=%s addons=%v config=%s", inst.GetProduct(), inst.GetAddons(), config))
+		return nil
+	}
+}
+
+func formatTs(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.DateTime)
+}
+
+func loadYAML(file string, target any) error {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(body, target)
+}
+
+func loadProto(file string, msg proto.Message) error {
+	var raw any
+	if err := loadYAML(file, &raw); err != nil {
+		return err
+	}
+	return decodeProto(raw, msg)
+}
+
+func decodeProto(raw any, msg proto.Message) error {
+	body, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, msg)
+}
+
+func main() {
+	flag.Parse()
+
+	log := zap.NewNop()
+	if verbose {
+		log, _ = zap.NewDevelopment()
+	}
+
+	start, err := time.Parse(time.DateOnly, startDate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid start date:", err)
+		os.Exit(1)
+	}
+	end := start.AddDate(0, months, 0)
+
+	plan := &billingpb.Plan{}
+	if err = loadProto(planFile, plan); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load billing plan:", err)
+		os.Exit(1)
+	}
+
+	service := &spb.Service{}
+	if err = loadProto(serviceFile, service); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load service:", err)
+		os.Exit(1)
+	}
+
+	sp := &sppb.ServicesProvider{Uuid: "simulated-sp", Type: "virtual"}
+	if spFile != "" {
+		if err = loadProto(spFile, sp); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load services provider:", err)
+			os.Exit(1)
+		}
+	}
+
+	addons := make(map[string]*apb.Addon)
+	if addonsFile != "" {
+		var raw []any
+		if err = loadYAML(addonsFile, &raw); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load addons:", err)
+			os.Exit(1)
+		}
+		for _, a := range raw {
+			addon := &apb.Addon{}
+			if err = decodeProto(a, addon); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to decode addon:", err)
+				os.Exit(1)
+			}
+			addons[addon.GetUuid()] = addon
+		}
+	}
+
+	var (
+		group *ipb.InstancesGroup
+		inst  *ipb.Instance
+	)
+groups:
+	for _, g := range service.GetInstancesGroups() {
+		for _, i := range g.GetInstances() {
+			if instanceName == "" || i.GetTitle() == instanceName {
+				group, inst = g, i
+				break groups
+			}
+		}
+	}
+	if inst == nil {
+		fmt.Fprintln(os.Stderr, "Instance not found in service")
+		os.Exit(1)
+	}
+
+	if group.GetUuid() == "" {
+		group.Uuid = "simulated-group"
+	}
+	group.Instances = []*ipb.Instance{inst}
+	if inst.GetUuid() == "" {
+		inst.Uuid = "simulated-instance"
+	}
+	if inst.GetCreated() == 0 {
+		inst.Created = start.Unix()
+	}
+	if inst.GetState() == nil {
+		inst.State = &stpb.State{State: stpb.NoCloudState_RUNNING}
+	}
+	inst.BillingPlan = plan
+
+	sim := &simulation{
+		clock: utils.NewFakeClock(start),
+		state: inst.GetState(),
+		data:  inst.GetData(),
+	}
+
+	driverType := group.GetType()
+	if driverType == "" {
+		driverType = "virtual"
+	}
+	driver := server.NewDetachedVirtualDriver(log, driverType, sim.clock)
+	sim.setup(driver)
+	if ratesFile != "" {
+		rates, err := utils.LoadRates(ratesFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load currency rates:", err)
+			os.Exit(1)
+		}
+		driver.SetCurrencyRates(rates)
+	}
+
+	balances := map[string]float64{group.GetUuid(): balance}
+	ticks := 0
+	for now := start; now.Before(end); now = now.Add(step) {
+		sim.clock.Set(now)
+
+		_, _ = driver.Monitoring(context.Background(), &pb.MonitoringRequest{
+			Groups:           []*ipb.InstancesGroup{group},
+			ServicesProvider: sp,
+			Scheduled:        true,
+			Balance:          balances,
+			Addons:           addons,
+		})
+		driver.Wait()
+		ticks++
+
+		// Feed back what nocloud would have persisted
+		sim.mu.Lock()
+		inst.State = sim.state
+		inst.Data = maps.Clone(sim.data)
+		sim.mu.Unlock()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tKIND\tDETAILS")
+	for _, r := range sim.rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.ts.UTC().Format(time.DateTime), r.kind, r.details)
+	}
+	_ = w.Flush()
+
+	fmt.Printf("\n%d ticks from %s to %s, final balance %g\n", ticks, start.Format(time.DateOnly), end.Format(time.DateOnly), balances[group.GetUuid()])
+}
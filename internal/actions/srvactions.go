@@ -14,7 +14,6 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"time"
 
 	billingpb "github.com/slntopp/nocloud-proto/billing"
 	ipb "github.com/slntopp/nocloud-proto/instances"
@@ -37,7 +36,18 @@ func SetInstancesClient(client iconnect.InstancesServiceClient, token string) {
 	rootToken = token
 }
 
-type ServiceAction func(*zap.Logger, states.Pub, instances.Pub, *ipb.Instance, map[string]*structpb.Value) (*ipb.InvokeResponse, error)
+func UpdateInstance(ctx context.Context, inst *ipb.Instance) error {
+	if instancesClient == nil {
+		return fmt.Errorf("instances client is not set")
+	}
+	req := connect.NewRequest(&ipb.UpdateRequest{Instance: inst})
+	req.Header().Set("Authorization", "Bearer "+rootToken)
+	_, err := instancesClient.Update(ctx, req)
+	return err
+}
+
+// ServiceAction is called with the driver clock, so actions share the time source with billing
+type ServiceAction func(*zap.Logger, utils.Clock, states.Pub, instances.Pub, *ipb.Instance, map[string]*structpb.Value) (*ipb.InvokeResponse, error)
 
 type AnsibleAction func(
 	*zap.Logger,
@@ -53,19 +63,25 @@ var SrvActions = map[string]ServiceAction{
 	"freeze":       Freeze,
 	"unfreeze":     Unfreeze,
 	"cancel_renew": CancelRenew,
+	"report_usage": ReportUsage,
 }
 
 var BillingActions = map[string]ServiceAction{
-	"manual_renew": nil,
-	"cancel_renew": CancelRenew,
-	"free_renew":   FreeRenew,
+	"manual_renew":    nil,
+	"cancel_renew":    CancelRenew,
+	"free_renew":      FreeRenew,
+	"change_product":  nil,
+	"attach_addon":    nil,
+	"detach_addon":    nil,
+	"preview_billing": nil,
+	"refund":          nil,
 }
 
 var AnsibleActions = map[string]AnsibleAction{
 	"vpn": VpnAction,
 }
 
-func ChangeState(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+func ChangeState(log *zap.Logger, clock utils.Clock, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
 	state := int32(data["state"].GetNumberValue())
 	statepb := stpb.NoCloudState(state)
 
@@ -85,7 +101,7 @@ func ChangeState(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb
 	_, ok := iData["start"]
 
 	if statepb == stpb.NoCloudState_RUNNING && !ok {
-		iData["start"] = structpb.NewStringValue(time.Now().Format("2006-01-02"))
+		iData["start"] = structpb.NewStringValue(clock.Now().Format("2006-01-02"))
 		iPub(&ipb.ObjectData{
 			Uuid: inst.GetUuid(),
 			Data: iData,
@@ -101,8 +117,17 @@ func ChangeState(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb
 	}, nil
 }
 
-func Freeze(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+func Freeze(log *zap.Logger, clock utils.Clock, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	if inst.Data["freeze"].GetBoolValue() {
+		return &ipb.InvokeResponse{Result: false}, status.Error(codes.FailedPrecondition, "Instance is already frozen")
+	}
+
 	inst.Data["freeze"] = structpb.NewBoolValue(true)
+	inst.Data["freeze_start"] = structpb.NewNumberValue(float64(clock.Now().Unix()))
+	delete(inst.Data, "freeze_end")
 	iPub(&ipb.ObjectData{
 		Uuid: inst.GetUuid(),
 		Data: inst.GetData(),
@@ -113,11 +138,56 @@ func Freeze(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.Inst
 	}, nil
 }
 
-func Unfreeze(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
-	inst.Data["freeze"] = structpb.NewBoolValue(false)
+// Unfreeze shifts billing dates by the time instance was frozen, so frozen time is not paid for
+func Unfreeze(log *zap.Logger, clock utils.Clock, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+	instData := inst.GetData()
+	if !instData["freeze"].GetBoolValue() {
+		return &ipb.InvokeResponse{Result: false}, status.Error(codes.FailedPrecondition, "Instance is not frozen")
+	}
+
+	now := clock.Now().Unix()
+	// Instances frozen before freeze_start was recorded have no known duration, so nothing is shifted
+	start := now
+	startValue, known := instData["freeze_start"]
+	if known {
+		start = int64(startValue.GetNumberValue())
+	} else {
+		log.Warn("Freeze start is unknown, billing dates are not shifted")
+	}
+	duration := max(now-start, 0)
+
+	// Billing dates and pending deadlines, like grace period, retention and trial end
+	keys := []string{
+		"last_monitoring", "next_payment_date", "actual_last_monitoring", "actual_next_payment_date",
+		"trial_end", "suspended_at", "grace_period_start", "grace_period_reminder", "spending_period", "discount_period_end",
+	}
+	for _, addonId := range inst.GetAddons() {
+		keys = append(keys, fmt.Sprintf("addon_%s_last_monitoring", addonId))
+	}
+	for _, res := range inst.GetBillingPlan().GetResources() {
+		keys = append(keys, fmt.Sprintf("%s_last_monitoring", res.GetKey()))
+	}
+	for _, key := range keys {
+		if val, ok := instData[key]; ok {
+			instData[key] = structpb.NewNumberValue(val.GetNumberValue() + float64(duration))
+		}
+	}
+	log.Debug("Billing dates shifted", zap.Int64("duration", duration), zap.Strings("keys", keys))
+
+	if known {
+		history := instData["freeze_history"].GetListValue().GetValues()
+		history = append(history, structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"start": structpb.NewNumberValue(float64(start)),
+			"end":   structpb.NewNumberValue(float64(now)),
+		}}))
+		instData["freeze_history"] = structpb.NewListValue(&structpb.ListValue{Values: history})
+	}
+
+	instData["freeze"] = structpb.NewBoolValue(false)
+	instData["freeze_end"] = structpb.NewNumberValue(float64(now))
 	iPub(&ipb.ObjectData{
 		Uuid: inst.GetUuid(),
-		Data: inst.GetData(),
+		Data: instData,
 	})
 
 	return &ipb.InvokeResponse{
@@ -125,7 +195,7 @@ func Unfreeze(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.In
 	}, nil
 }
 
-func FreeRenew(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+func FreeRenew(log *zap.Logger, clock utils.Clock, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
 	log.Info("Request received")
 
 	instData := inst.GetData()
@@ -162,14 +232,16 @@ func FreeRenew(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.I
 	for _, addonId := range inst.Addons {
 		key := fmt.Sprintf("addon_%s_last_monitoring", addonId)
 		lmValue, ok := instData[key]
-		if ok {
-			lm := int64(lmValue.GetNumberValue())
-			end := lm + period
-			if pkind != billingpb.PeriodKind_DEFAULT {
-				end = utils.AlignPaymentDate(lm, end, period, inst)
-			}
-			instData[key] = structpb.NewNumberValue(float64(end))
+		if !ok {
+			continue
+		}
+		lm := int64(lmValue.GetNumberValue())
+		// Addons with own period are renewed only if they expire within renewed product period, as on paid renew
+		if _, own := instData[fmt.Sprintf("addon_%s_period", addonId)]; own && lm >= end {
+			continue
 		}
+		addonPeriod, addonKind := utils.StoredAddonPeriod(instData, addonId, product)
+		instData[key] = structpb.NewNumberValue(float64(utils.NextPaymentDate(lm, addonPeriod, addonKind, inst)))
 	}
 
 	log.Info("Publishing renewed instance data")
@@ -181,7 +253,7 @@ func FreeRenew(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.I
 	return &ipb.InvokeResponse{Result: true}, nil
 }
 
-func CancelRenew(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+func CancelRenew(log *zap.Logger, clock utils.Clock, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
 	instData := inst.GetData()
 	instProduct := inst.GetProduct()
 	billingPlan := inst.GetBillingPlan()
@@ -197,25 +269,90 @@ func CancelRenew(log *zap.Logger, sPub states.Pub, iPub instances.Pub, inst *ipb
 	}
 	lastMonitoringValue := int64(lastMonitoring.GetNumberValue())
 
-	period := billingPlan.GetProducts()[instProduct].GetPeriod()
+	product := billingPlan.GetProducts()[instProduct]
+	period, pkind := product.GetPeriod(), product.GetPeriodKind()
 
-	lastMonitoringValue = utils.AlignPaymentDate(lastMonitoringValue, lastMonitoringValue-period, period, inst)
+	productEnd := lastMonitoringValue
+	lastMonitoringValue = utils.PreviousPaymentDate(lastMonitoringValue, period, pkind, inst)
 	instData["last_monitoring"] = structpb.NewNumberValue(float64(lastMonitoringValue))
 
 	for _, addonId := range inst.Addons {
 		key := fmt.Sprintf("addon_%s_last_monitoring", addonId)
 		lmValue, ok := instData[key]
-		if ok {
-			lm := int64(lmValue.GetNumberValue())
-			lm = utils.AlignPaymentDate(lm, lm-period, period, inst)
-			instData[key] = structpb.NewNumberValue(float64(lm))
+		if !ok {
+			continue
+		}
+		addonPeriod, addonKind := utils.StoredAddonPeriod(instData, addonId, product)
+		prev := utils.PreviousPaymentDate(int64(lmValue.GetNumberValue()), addonPeriod, addonKind, inst)
+		// Addons with own period were renewed only if they expired within cancelled product period
+		if _, own := instData[fmt.Sprintf("addon_%s_period", addonId)]; own && prev >= productEnd {
+			continue
 		}
+		instData[key] = structpb.NewNumberValue(float64(prev))
 	}
 
 	utils.SendActualMonitoringData(instData, instData, inst.GetUuid(), iPub)
 	return &ipb.InvokeResponse{Result: true}, nil
 }
 
+func ReportUsage(log *zap.Logger, clock utils.Clock, sPub states.Pub, iPub instances.Pub, inst *ipb.Instance, data map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+	key := data["resource"].GetStringValue()
+	if key == "" {
+		return &ipb.InvokeResponse{Result: false}, status.Error(codes.InvalidArgument, "No resource provided")
+	}
+	quantity := data["quantity"].GetNumberValue()
+	if quantity <= 0 {
+		return &ipb.InvokeResponse{Result: false}, status.Error(codes.InvalidArgument, "Quantity must be positive")
+	}
+
+	var resource *billingpb.ResourceConf
+	for _, res := range inst.GetBillingPlan().GetResources() {
+		if res.GetKey() == key {
+			resource = res
+			break
+		}
+	}
+	if resource == nil {
+		return &ipb.InvokeResponse{Result: false}, status.Error(codes.NotFound, "Resource not found in billing plan")
+	}
+	if !utils.ResourceMetered(resource) {
+		return &ipb.InvokeResponse{Result: false}, status.Error(codes.InvalidArgument, "Resource is not usage metered")
+	}
+	// Usage is accepted only while the resource is billed, accepted usage is billed regardless of later state changes
+	if !utils.ResourceActive(resource, inst.GetState().GetState()) {
+		return &ipb.InvokeResponse{Result: false}, status.Error(codes.FailedPrecondition, "Resource is not billed in current instance state")
+	}
+
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	instData := inst.GetData()
+
+	usageKey := fmt.Sprintf("%s_usage", key)
+	startKey := fmt.Sprintf("%s_usage_start", key)
+	endKey := fmt.Sprintf("%s_usage_end", key)
+	now := structpb.NewNumberValue(float64(clock.Now().Unix()))
+	if _, ok := instData[startKey]; !ok {
+		instData[startKey] = now
+	}
+	instData[endKey] = now
+	usage := instData[usageKey].GetNumberValue() + quantity
+	instData[usageKey] = structpb.NewNumberValue(usage)
+
+	log.Debug("Usage reported", zap.String("resource", key), zap.Float64("quantity", quantity), zap.Float64("usage", usage))
+	iPub(&ipb.ObjectData{
+		Uuid: inst.GetUuid(),
+		Data: instData,
+	})
+
+	return &ipb.InvokeResponse{
+		Result: true,
+		Meta: map[string]*structpb.Value{
+			"usage": structpb.NewNumberValue(usage),
+		},
+	}, nil
+}
+
 type AnsibleError struct {
 	Code        string `json:"code"`
 	Message     string `json:"message"`
@@ -0,0 +1,221 @@
+package actions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	billingpb "github.com/slntopp/nocloud-proto/billing"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	stpb "github.com/slntopp/nocloud-proto/states"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func noStatePub(*stpb.ObjectState) (int, error) { return 0, nil }
+
+func noDataPub(*ipb.ObjectData) (int, error) { return 0, nil }
+
+func TestFreezeUsesClock(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2026, 2, 28, 12, 0, 0, 0, time.UTC))
+	inst := &ipb.Instance{Uuid: "inst"}
+
+	if _, err := Freeze(zap.NewNop(), clock, noStatePub, noDataPub, inst, nil); err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+	if got := int64(inst.Data["freeze_start"].GetNumberValue()); got != clock.Now().Unix() {
+		t.Errorf("freeze_start = %d, want %d", got, clock.Now().Unix())
+	}
+
+	clock.Advance(72 * time.Hour)
+	if _, err := Unfreeze(zap.NewNop(), clock, noStatePub, noDataPub, inst, nil); err != nil {
+		t.Fatalf("Unfreeze: %v", err)
+	}
+	if got := int64(inst.Data["freeze_end"].GetNumberValue()); got != clock.Now().Unix() {
+		t.Errorf("freeze_end = %d, want %d", got, clock.Now().Unix())
+	}
+	if inst.Data["freeze"].GetBoolValue() {
+		t.Error("instance is still frozen")
+	}
+}
+
+func TestFreezeTwice(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	inst := &ipb.Instance{Data: map[string]*structpb.Value{"freeze": structpb.NewBoolValue(true)}}
+	if _, err := Freeze(zap.NewNop(), clock, noStatePub, noDataPub, inst, nil); err == nil {
+		t.Error("frozen instance was frozen again")
+	}
+}
+
+func TestUnfreezeShiftsDeadlines(t *testing.T) {
+	start := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	clock := utils.NewFakeClock(start.Add(5 * 24 * time.Hour))
+	frozen := float64(5 * 86400)
+
+	keys := []string{"last_monitoring", "next_payment_date", "trial_end", "suspended_at", "grace_period_start",
+		"addon_backup_last_monitoring", "cpu_last_monitoring"}
+	data := map[string]*structpb.Value{
+		"freeze":       structpb.NewBoolValue(true),
+		"freeze_start": structpb.NewNumberValue(float64(start.Unix())),
+	}
+	for n, key := range keys {
+		data[key] = structpb.NewNumberValue(float64(start.Unix() + int64(n)))
+	}
+	inst := &ipb.Instance{
+		Addons: []string{"backup"},
+		BillingPlan: &billingpb.Plan{
+			Resources: []*billingpb.ResourceConf{{Key: "cpu"}},
+		},
+		Data: data,
+	}
+
+	if _, err := Unfreeze(zap.NewNop(), clock, noStatePub, noDataPub, inst, nil); err != nil {
+		t.Fatalf("Unfreeze: %v", err)
+	}
+	for n, key := range keys {
+		want := float64(start.Unix()+int64(n)) + frozen
+		if got := inst.Data[key].GetNumberValue(); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	if history := inst.Data["freeze_history"].GetListValue().GetValues(); len(history) != 1 {
+		t.Errorf("freeze history has %d entries, want 1", len(history))
+	}
+}
+
+func TestUnfreezeWithoutFreezeStart(t *testing.T) {
+	// Instances frozen before freeze_start was introduced
+	clock := utils.NewFakeClock(time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC))
+	lm := float64(time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC).Unix())
+	inst := &ipb.Instance{Data: map[string]*structpb.Value{
+		"freeze":          structpb.NewBoolValue(true),
+		"last_monitoring": structpb.NewNumberValue(lm),
+		"suspended_at":    structpb.NewNumberValue(lm),
+	}}
+
+	if _, err := Unfreeze(zap.NewNop(), clock, noStatePub, noDataPub, inst, nil); err != nil {
+		t.Fatalf("Unfreeze: %v", err)
+	}
+	if got := inst.Data["last_monitoring"].GetNumberValue(); got != lm {
+		t.Errorf("last_monitoring = %v, want unchanged %v", time.Unix(int64(got), 0).UTC(), time.Unix(int64(lm), 0).UTC())
+	}
+	if got := inst.Data["suspended_at"].GetNumberValue(); got != lm {
+		t.Errorf("suspended_at = %v, want unchanged %v", got, lm)
+	}
+	if inst.Data["freeze"].GetBoolValue() {
+		t.Error("instance is still frozen")
+	}
+}
+
+func TestCancelRenewDefaultPeriod(t *testing.T) {
+	may2 := float64(time.Date(2026, 5, 2, 0, 0, 0, 0, time.UTC).Unix())
+	tests := []struct {
+		name string
+		kind billingpb.PeriodKind
+		want time.Time
+	}{
+		// Default period kind rolls back by exact number of seconds
+		{"default", billingpb.PeriodKind_DEFAULT, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"calendar", billingpb.PeriodKind_CALENDAR_MONTH, time.Date(2026, 2, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inst := &ipb.Instance{
+				Product: func() *string { p := "quarter"; return &p }(),
+				BillingPlan: &billingpb.Plan{
+					Kind: billingpb.PlanKind_STATIC,
+					Products: map[string]*billingpb.Product{
+						"quarter": {Period: 90 * 86400, PeriodKind: tt.kind},
+					},
+				},
+				Data: map[string]*structpb.Value{"last_monitoring": structpb.NewNumberValue(may2)},
+			}
+			if _, err := CancelRenew(zap.NewNop(), utils.SystemClock{}, noStatePub, noDataPub, inst, nil); err != nil {
+				t.Fatalf("CancelRenew: %v", err)
+			}
+			if got := int64(inst.Data["last_monitoring"].GetNumberValue()); got != tt.want.Unix() {
+				t.Errorf("last_monitoring = %v, want %v", time.Unix(got, 0).UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRenewAddonOwnPeriod(t *testing.T) {
+	jan31, feb28 := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)
+	inst := &ipb.Instance{
+		Created: jan31.Unix(),
+		Product: func() *string { p := "month"; return &p }(),
+		Addons:  []string{"backup", "license"},
+		BillingPlan: &billingpb.Plan{
+			Kind: billingpb.PlanKind_STATIC,
+			Products: map[string]*billingpb.Product{
+				"month": {Period: 30 * 86400, PeriodKind: billingpb.PeriodKind_CALENDAR_MONTH},
+			},
+		},
+		Data: map[string]*structpb.Value{
+			"last_monitoring":              structpb.NewNumberValue(float64(jan31.Unix())),
+			"addon_backup_last_monitoring": structpb.NewNumberValue(float64(jan31.Unix())),
+			// Weekly license expiring within the product period
+			"addon_license_last_monitoring": structpb.NewNumberValue(float64(jan31.Unix())),
+			"addon_license_period":          structpb.NewNumberValue(7 * 86400),
+			"addon_license_period_kind":     structpb.NewNumberValue(float64(billingpb.PeriodKind_DEFAULT)),
+		},
+	}
+	lm := func(key string) time.Time {
+		return time.Unix(int64(inst.Data[key].GetNumberValue()), 0).UTC()
+	}
+
+	if _, err := FreeRenew(zap.NewNop(), utils.SystemClock{}, noStatePub, noDataPub, inst, nil); err != nil {
+		t.Fatalf("FreeRenew: %v", err)
+	}
+	if got := lm("addon_backup_last_monitoring"); !got.Equal(feb28) {
+		t.Errorf("backup renewed to %v, want %v", got, feb28)
+	}
+	if got, want := lm("addon_license_last_monitoring"), jan31.AddDate(0, 0, 7); !got.Equal(want) {
+		t.Errorf("license renewed to %v, want %v", got, want)
+	}
+
+	if _, err := CancelRenew(zap.NewNop(), utils.SystemClock{}, noStatePub, noDataPub, inst, nil); err != nil {
+		t.Fatalf("CancelRenew: %v", err)
+	}
+	for _, key := range []string{"last_monitoring", "addon_backup_last_monitoring", "addon_license_last_monitoring"} {
+		if got := lm(key); !got.Equal(jan31) {
+			t.Errorf("%s rolled back to %v, want %v", key, got, jan31)
+		}
+	}
+}
+
+func TestReportUsageState(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	inst := &ipb.Instance{
+		State: &stpb.State{State: stpb.NoCloudState_SUSPENDED},
+		BillingPlan: &billingpb.Plan{
+			Resources: []*billingpb.ResourceConf{{
+				Key:  "traffic",
+				On:   []stpb.NoCloudState{stpb.NoCloudState_RUNNING},
+				Meta: map[string]*structpb.Value{"metered": structpb.NewBoolValue(true)},
+			}},
+		},
+	}
+	data := map[string]*structpb.Value{
+		"resource": structpb.NewStringValue("traffic"),
+		"quantity": structpb.NewNumberValue(5),
+	}
+
+	if _, err := ReportUsage(zap.NewNop(), clock, noStatePub, noDataPub, inst, data); err == nil {
+		t.Error("usage is accepted while resource isn't billed")
+	}
+	if _, ok := inst.GetData()["traffic_usage"]; ok {
+		t.Error("rejected usage is stored")
+	}
+
+	inst.State.State = stpb.NoCloudState_RUNNING
+	if _, err := ReportUsage(zap.NewNop(), clock, noStatePub, noDataPub, inst, data); err != nil {
+		t.Fatalf("ReportUsage: %v", err)
+	}
+	if got := inst.Data["traffic_usage"].GetNumberValue(); got != 5 {
+		t.Errorf("traffic_usage = %v, want 5", got)
+	}
+}
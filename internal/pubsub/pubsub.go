@@ -2,6 +2,7 @@ package pubsub
 
 import (
 	"context"
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
 	"github.com/slntopp/nocloud/pkg/nocloud/rabbitmq"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -36,7 +37,7 @@ func SetupRecordsPublisher(logger *zap.Logger, rbmq *amqp.Connection) RecordsPub
 		//	defer ch.Close()
 		//}
 
-		for _, record := range payload {
+		for _, record := range utils.WithIdempotencyKey(payload) {
 			body, err := proto.Marshal(record)
 			if err != nil {
 				log.Error("Error while marshalling record", zap.Error(err))
@@ -44,6 +45,7 @@ func SetupRecordsPublisher(logger *zap.Logger, rbmq *amqp.Connection) RecordsPub
 			}
 			err = ch.PublishWithContext(context.Background(), "", qName, false, false, amqp.Publishing{
 				ContentType: "text/plain", Body: body,
+				MessageId: record.GetMeta()["idempotency_key"].GetStringValue(),
 			})
 			if err != nil {
 				log.Warn("Couldn't publish records to the queue", zap.Error(err))
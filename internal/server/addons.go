@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	"github.com/slntopp/nocloud-proto/instances"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// addonPeriod returns addon billing period. Addon may declare own period (seconds) and period_kind in meta,
+// e.g. yearly license on monthly product, otherwise it follows the product
+func addonPeriod(addon *apb.Addon, product *billing.Product) (int64, billing.PeriodKind) {
+	val, ok := addon.GetMeta()["period"]
+	if !ok {
+		return product.GetPeriod(), product.GetPeriodKind()
+	}
+	kind := billing.PeriodKind(billing.PeriodKind_value[addon.GetMeta()["period_kind"].GetStringValue()])
+	return int64(val.GetNumberValue()), kind
+}
+
+// storeAddonPeriod saves addon own period in instance data, so it is known to routines called without addons,
+// see utils.StoredAddonPeriod
+func storeAddonPeriod(i *instances.Instance, addon *apb.Addon, product *billing.Product) {
+	periodKey := fmt.Sprintf("addon_%s_period", addon.GetUuid())
+	kindKey := fmt.Sprintf("addon_%s_period_kind", addon.GetUuid())
+	if _, ok := addon.GetMeta()["period"]; !ok {
+		delete(i.Data, periodKey)
+		delete(i.Data, kindKey)
+		return
+	}
+	period, kind := addonPeriod(addon, product)
+	if i.Data == nil {
+		i.Data = make(map[string]*structpb.Value)
+	}
+	i.Data[periodKey] = structpb.NewNumberValue(float64(period))
+	i.Data[kindKey] = structpb.NewNumberValue(float64(kind))
+}
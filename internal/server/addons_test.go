@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud-proto/instances"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestAttachAddonWithoutData(t *testing.T) {
+	addons := map[string]string{
+		"one-time": `{"uuid": "one-time", "kind": 2, "periods": {"0": 5}}`,
+		"own":      `{"uuid": "own", "kind": 2, "periods": {"31536000": 50}, "meta": {"period": 31536000}}`,
+	}
+	for name, addon := range addons {
+		t.Run(name, func(t *testing.T) {
+			product := "once"
+			inst := &instances.Instance{
+				Uuid:    "inst",
+				Product: &product,
+				BillingPlan: &billing.Plan{
+					Products: map[string]*billing.Product{product: {Kind: billing.Kind_PREPAID, Price: 10}},
+				},
+			}
+			def := &structpb.Value{}
+			if err := def.UnmarshalJSON([]byte(addon)); err != nil {
+				t.Fatal(err)
+			}
+			params := map[string]*structpb.Value{
+				"addon":  structpb.NewStringValue(name),
+				"addons": structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{def}}),
+			}
+
+			s, published := testDriver(utils.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)))
+			if err := s._handleAttachAddon(context.Background(), inst, nil, params); err != nil {
+				t.Fatalf("attach: %v", err)
+			}
+			if records := published(); len(records) != 1 {
+				t.Errorf("got %d records, want 1", len(records))
+			}
+			if _, ok := inst.Data["addon_"+name+"_last_monitoring"]; !ok {
+				t.Error("addon last monitoring isn't set")
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
@@ -36,11 +38,37 @@ var notificationsPeriods = []ExpiryDiff{
 	{2592000, 30},
 }
 
-func (s *VirtualDriver) _handleInstanceBilling(i *instances.Instance, balance *float64, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) {
+// notificationPeriods returns expiry notification schedule, given in days, e.g. [60, 30, 7].
+// Product meta takes precedence over billing plan meta and SP variables, notificationsPeriods are used by default
+func notificationPeriods(i *instances.Instance, product *billing.Product, sp *sppb.ServicesProvider) []ExpiryDiff {
+	val, ok := product.GetMeta()["notification_periods"]
+	if !ok {
+		val, ok = i.GetBillingPlan().GetMeta()["notification_periods"]
+	}
+	if !ok {
+		val, ok = sp.GetVars()["notification_periods"].GetValue()["default"]
+	}
+	if !ok || len(val.GetListValue().GetValues()) == 0 {
+		return notificationsPeriods
+	}
+
+	var periods []ExpiryDiff
+	for _, day := range val.GetListValue().GetValues() {
+		days := int64(day.GetNumberValue())
+		periods = append(periods, ExpiryDiff{days * 86400, days})
+	}
+	slices.SortFunc(periods, func(a, b ExpiryDiff) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	return periods
+}
+
+func (s *VirtualDriver) _handleInstanceBilling(i *instances.Instance, balance *ledger, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) {
 	log := s.log.Named("BillingHandler").Named(i.GetUuid())
 	log.Debug("Initializing")
 
 	status := i.GetStatus()
+	now := s.clock.Now().Unix()
 
 	// Create copy of instance data
 	var dataCopy = map[string]*structpb.Value{}
@@ -61,21 +89,14 @@ func (s *VirtualDriver) _handleInstanceBilling(i *instances.Instance, balance *f
 		log.Warn("Instance data is not initialized")
 		i.Data = make(map[string]*structpb.Value)
 	}
-	config := i.GetConfig()
 
 	var records []*billing.Record
 
-	var skipPayment []any
-
-	if config != nil {
-		skipPayment = config["skip_next_payment"].GetListValue().AsSlice()
-	}
+	skip := skippedPayments(i)
 
 	if plan.Kind == billing.PlanKind_STATIC {
 		product := i.GetBillingPlan().GetProducts()[i.GetProduct()]
 
-		var iProduct any = i.GetProduct()
-
 		var last int64
 		var priority billing.Priority
 
@@ -103,9 +124,11 @@ func (s *VirtualDriver) _handleInstanceBilling(i *instances.Instance, balance *f
 				priority = billing.Priority_NORMAL
 			}
 
-			recs, last := handleAddonBilling(log, i, lm, priority, addon)
+			storeAddonPeriod(i, addon, product)
+			period, _ := addonPeriod(addon, product)
+			recs, last := handleAddonBilling(log, i, lm, priority, addon, now)
 			if len(recs) > 0 {
-				if product.GetPeriod() == 0 {
+				if period == 0 {
 					if !ok {
 						records = append(records, recs...)
 						i.Data[fmt.Sprintf("addon_%s_last_monitoring", addonId)] = structpb.NewNumberValue(float64(last))
@@ -123,23 +146,23 @@ func (s *VirtualDriver) _handleInstanceBilling(i *instances.Instance, balance *f
 			last = int64(i.Data["last_monitoring"].GetNumberValue())
 			priority = billing.Priority_NORMAL
 		} else {
-			last = time.Now().Unix()
+			last = firstPaymentDate(i, now)
 			priority = billing.Priority_URGENT
+			if trial, end, started := s.handleTrial(log, i, product, last); started {
+				records = append(records, trial...)
+				last = end
+			}
 		}
 
 		if product.GetPeriod() == 0 {
 			if !ok {
-				if !slices.Contains(skipPayment, iProduct) {
-					records = append(records, handleOneTimePayment(log, i, last, priority)...)
-				}
+				records = append(records, handleOneTimePayment(log, i, last, priority)...)
 				i.Data["last_monitoring"] = structpb.NewNumberValue(float64(last))
 			}
 		} else {
-			new, last := handleStaticBilling(log, i, last, priority)
+			new, last := handleStaticBilling(log, i, last, priority, now)
 			if len(new) != 0 {
-				if ok || (!ok && !slices.Contains(skipPayment, iProduct)) {
-					records = append(records, new...)
-				}
+				records = append(records, new...)
 				i.Data["last_monitoring"] = structpb.NewNumberValue(float64(last))
 			}
 
@@ -157,18 +180,23 @@ func (s *VirtualDriver) _handleInstanceBilling(i *instances.Instance, balance *f
 		}
 	}
 
+	records = append(records, handleResourcesBilling(log, i, now)...)
+	records, skipped := skipPayments(records, skip)
+	records = dropCappedRecords(log, i, records)
+	applyDiscount(log, i, sp, records, now)
+
 	if len(records) != 0 && status == statusespb.NoCloudStatus_SUS {
 		log.Debug("SUS")
 		if i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
 
-			if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), time.Now().UTC()) {
-				go s.HandlePublishInstanceState(&statespb.ObjectState{
+			if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), s.clock.Now().UTC()) {
+				s.publishInstanceStateAsync(&statespb.ObjectState{
 					Uuid: i.GetUuid(),
 					State: &statespb.State{
 						State: statespb.NoCloudState_SUSPENDED,
 					},
 				})
-				go s.HandlePublishEvent(&epb.Event{
+				s.publishEventAsync(&epb.Event{
 					Uuid: i.GetUuid(),
 					Key:  "instance_suspended",
 					Data: map[string]*structpb.Value{},
@@ -179,88 +207,159 @@ func (s *VirtualDriver) _handleInstanceBilling(i *instances.Instance, balance *f
 		}
 	} else {
 		log.Debug("NOT SUS")
-		var price float64
-		for _, rec := range records {
-			if rec.Addon != "" {
-				price += rec.GetTotal() * calculateAddonPrice(addons, i, rec.Addon)
-			} else {
-				price += rec.GetTotal() * calculateProductPrice(i, rec.Product)
-			}
+		price, err := calculateRecordsPrice(records, addons, i, s.currencyConverter(i, sp))
+		if err != nil {
+			log.Error("Failed to calculate price", zap.Error(err))
+			utils.SendActualMonitoringData(dataCopy, i.Data, i.GetUuid(), s.HandlePublishInstanceData)
+			return
 		}
+		// Balance is charged with tax unless it's included into prices
+		tax := instanceTax(i, sp)
+		price = tax.gross(price)
+		applyTax(tax, records)
 
-		if price > *balance {
-			if i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
-
-				if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), time.Now().UTC()) {
-					go s.HandlePublishInstanceState(&statespb.ObjectState{
-						Uuid: i.GetUuid(),
-						State: &statespb.State{
-							State: statespb.NoCloudState_SUSPENDED,
-						},
-					})
-					go s.HandlePublishEvent(&epb.Event{
-						Uuid: i.GetUuid(),
-						Key:  "instance_suspended",
-						Data: map[string]*structpb.Value{},
-					})
-				}
-
-			}
-
+		limit := creditLimit(i, sp)
+		credit, ok := balance.reserve(price, limit)
+		if !ok {
+			s.handleUnpaid(log, i, sp, dataCopy, now)
 			utils.SendActualMonitoringData(dataCopy, i.Data, i.GetUuid(), s.HandlePublishInstanceData)
 			return
 		}
+		if credit > 0 {
+			log.Debug("Renewed on credit", zap.Float64("credit", credit), zap.Float64("limit", limit))
+			s.publishEventAsync(&epb.Event{
+				Uuid: i.GetUuid(),
+				Key:  "credit_used",
+				Data: map[string]*structpb.Value{
+					"amount":  structpb.NewNumberValue(credit),
+					"balance": structpb.NewNumberValue(balance.Balance()),
+					"limit":   structpb.NewNumberValue(limit),
+				},
+			})
+		}
 
-		*balance -= price
-		if i.GetState().GetState() == statespb.NoCloudState_SUSPENDED {
-			go s.HandlePublishInstanceState(&statespb.ObjectState{
+		clearGracePeriod(i.Data)
+		limitReached := s.handleSpendingLimit(log, i, sp, addons, records)
+		if limitReached && i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
+			s.suspendInstance(i, sp, i.Data, now)
+		} else if !limitReached && i.GetState().GetState() == statespb.NoCloudState_SUSPENDED {
+			s.publishInstanceStateAsync(&statespb.ObjectState{
 				Uuid: i.GetUuid(),
 				State: &statespb.State{
 					State: statespb.NoCloudState_RUNNING,
 				},
 			})
-			go s.HandlePublishEvent(&epb.Event{
+			s.publishEventAsync(&epb.Event{
 				Uuid: i.GetUuid(),
 				Key:  "instance_unsuspended",
 				Data: map[string]*structpb.Value{},
 			})
 		}
-		s._handleEvent(i)
+		s.consumeSkippedPayments(log, i, skipped)
+		s.handleTrialEnding(i, now)
+		s._handleEvent(i, addons, sp)
 		s.HandlePublishRecords(records)
 		utils.SendActualMonitoringData(i.Data, i.Data, i.GetUuid(), s.HandlePublishInstanceData)
 	}
 }
 
-func calculateProductPrice(i *instances.Instance, prod string) float64 {
+// currencyConverter converts plan prices to the currency of account balance
+type currencyConverter struct {
+	rates utils.Rates
+	to    string
+}
+
+func (s *VirtualDriver) currencyConverter(i *instances.Instance, sp *sppb.ServicesProvider) *currencyConverter {
+	rates := maps.Clone(s.rates)
+	if rates == nil {
+		rates = utils.Rates{}
+	}
+	// SP rates take precedence over the local ones
+	maps.Copy(rates, utils.RatesFromValue(sp.GetSecrets()["currency_rates"]))
+
+	to := i.GetConfig()["currency"].GetStringValue()
+	if to == "" {
+		to = sp.GetSecrets()["currency"].GetStringValue()
+	}
+	return &currencyConverter{rates: rates, to: to}
+}
+
+func (c *currencyConverter) convert(amount float64, from string) (float64, error) {
+	return c.rates.Convert(amount, from, c.to)
+}
+
+func planCurrency(i *instances.Instance) string {
+	return i.GetBillingPlan().GetMeta()["currency"].GetStringValue()
+}
+
+func calculateRecordsPrice(records []*billing.Record, addons map[string]*apb.Addon, i *instances.Instance, conv *currencyConverter) (float64, error) {
+	var price float64
+	for _, rec := range records {
+		var (
+			p   float64
+			err error
+		)
+		if rec.Addon != "" {
+			p, err = calculateAddonPrice(addons, i, rec.Addon, conv)
+		} else if rec.Resource != "" {
+			p, err = calculateResourcePrice(i, rec.Resource, conv)
+		} else {
+			p, err = calculateProductPrice(i, rec.Product, conv)
+		}
+		if err != nil {
+			return 0, err
+		}
+		price += rec.GetTotal() * p
+	}
+	return price, nil
+}
+
+func calculateProductPrice(i *instances.Instance, prod string, conv *currencyConverter) (float64, error) {
 	if i.BillingPlan == nil || i.BillingPlan.Products == nil {
-		return 0
+		return 0, nil
 	}
 	bpProd, ok := i.BillingPlan.Products[prod]
 	if !ok {
-		return 0
+		return 0, nil
 	}
-	return bpProd.Price
+	return conv.convert(bpProd.Price, planCurrency(i))
 }
 
-func calculateAddonPrice(addons map[string]*apb.Addon, i *instances.Instance, id string) float64 {
+func calculateAddonPrice(addons map[string]*apb.Addon, i *instances.Instance, id string, conv *currencyConverter) (float64, error) {
 	if i.BillingPlan == nil || i.BillingPlan.Products == nil || i.Product == nil {
-		return 0
+		return 0, nil
 	}
 	addon, ok := addons[id]
 	if !ok {
-		return 0
+		return 0, nil
 	}
 	if addon.Periods == nil {
-		return 0
+		return 0, nil
 	}
-	period := i.BillingPlan.Products[*i.Product].Period
-	return addon.Periods[period]
+	period, _ := addonPeriod(addon, i.BillingPlan.Products[*i.Product])
+
+	currency := addon.GetMeta()["currency"].GetStringValue()
+	if currency == "" {
+		currency = planCurrency(i)
+	}
+	return conv.convert(addon.Periods[period], currency)
+}
+
+func calculateResourcePrice(i *instances.Instance, key string, conv *currencyConverter) (float64, error) {
+	for _, res := range i.GetBillingPlan().GetResources() {
+		if res.GetKey() == key {
+			return conv.convert(res.GetPrice(), planCurrency(i))
+		}
+	}
+	return 0, nil
 }
 
 func (s *VirtualDriver) _handleNonRegularBilling(i *instances.Instance, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) {
 	log := s.log.Named("NonReg").Named(i.GetUuid())
 	log.Debug("Initializing")
 
+	now := s.clock.Now().Unix()
+
 	if statespb.NoCloudState_PENDING == i.GetState().GetState() {
 		log.Info("Instance state is init. No instance billing", zap.String("uuid", i.GetUuid()))
 		return
@@ -271,48 +370,67 @@ func (s *VirtualDriver) _handleNonRegularBilling(i *instances.Instance, addons m
 		i.Data = make(map[string]*structpb.Value)
 	}
 
-	if lastMonitoring, ok := i.GetData()["last_monitoring"]; ok {
+	// Skipped payments are read before billing moves last monitoring of the items
+	skip := skippedPayments(i)
+
+	// Instances without auto renew are paid manually and their records aren't checked against the balance,
+	// so resources are charged only while the product is paid. Time the product is expired isn't charged
+	var resourceRecords []*billing.Record
+	lastMonitoring, ok := i.GetData()["last_monitoring"]
+	if ok && productExpired(i.GetBillingPlan().GetProducts()[i.GetProduct()], int64(lastMonitoring.GetNumberValue()), now) {
+		pauseResourcesBilling(i, now)
+	} else {
+		resourceRecords = handleResourcesBilling(log, i, now)
+	}
+
+	resourceRecords, skipped := skipPayments(resourceRecords, skip)
+	s.consumeSkippedPayments(log, i, skipped)
+
+	if ok {
+		resourceRecords = dropCappedRecords(log, i, resourceRecords)
+		if len(resourceRecords) != 0 {
+			applyTax(instanceTax(i, sp), resourceRecords)
+			s.HandlePublishRecords(resourceRecords)
+		}
+		limitReached := s.handleSpendingLimit(log, i, sp, addons, resourceRecords)
+
 		product := i.GetBillingPlan().GetProducts()[i.GetProduct()]
 
 		if product.GetPeriod() == 0 {
+			if limitReached && i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
+				s.suspendInstance(i, sp, i.Data, now)
+			}
+			if len(i.GetBillingPlan().GetResources()) != 0 {
+				utils.SendActualMonitoringData(i.Data, i.Data, i.GetUuid(), s.HandlePublishInstanceData)
+			}
 			return
 		}
 
-		now := time.Now().Unix()
 		lastMonitoringValue := int64(lastMonitoring.GetNumberValue())
 
 		suspendedManually := i.GetData()["suspended_manually"].GetBoolValue()
 
 		if product.GetKind() == billing.Kind_POSTPAID {
-			if now > lastMonitoringValue+product.GetPeriod() && i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
-
-				if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), time.Now().UTC()) {
-					go s.HandlePublishInstanceState(&statespb.ObjectState{
+			if productExpired(product, lastMonitoringValue, now) {
+				s.handleUnpaid(log, i, sp, i.Data, now)
+			} else {
+				clearGracePeriod(i.Data)
+				if limitReached && i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
+					s.suspendInstance(i, sp, i.Data, now)
+				} else if !limitReached && i.GetState().GetState() == statespb.NoCloudState_SUSPENDED && !suspendedManually {
+					s.publishInstanceStateAsync(&statespb.ObjectState{
 						Uuid: i.GetUuid(),
 						State: &statespb.State{
-							State: statespb.NoCloudState_SUSPENDED,
+							State: statespb.NoCloudState_RUNNING,
 						},
 					})
-					go s.HandlePublishEvent(&epb.Event{
+
+					s.publishEventAsync(&epb.Event{
 						Uuid: i.GetUuid(),
-						Key:  "instance_suspended",
+						Key:  "instance_unsuspended",
 						Data: map[string]*structpb.Value{},
 					})
 				}
-
-			} else if now <= lastMonitoringValue+product.GetPeriod() && i.GetState().GetState() == statespb.NoCloudState_SUSPENDED && !suspendedManually {
-				go s.HandlePublishInstanceState(&statespb.ObjectState{
-					Uuid: i.GetUuid(),
-					State: &statespb.State{
-						State: statespb.NoCloudState_RUNNING,
-					},
-				})
-
-				go s.HandlePublishEvent(&epb.Event{
-					Uuid: i.GetUuid(),
-					Key:  "instance_unsuspended",
-					Data: map[string]*structpb.Value{},
-				})
 			}
 
 			end := lastMonitoringValue + product.GetPeriod()
@@ -323,40 +441,32 @@ func (s *VirtualDriver) _handleNonRegularBilling(i *instances.Instance, addons m
 
 			i.Data["next_payment_date"] = structpb.NewNumberValue(float64(end))
 		} else {
-			if now > lastMonitoringValue && i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
-
-				if suspend_rules.SuspendAllowed(sp.GetSuspendRules(), time.Now().UTC()) {
-					go s.HandlePublishInstanceState(&statespb.ObjectState{
+			if productExpired(product, lastMonitoringValue, now) {
+				s.handleUnpaid(log, i, sp, i.Data, now)
+			} else {
+				clearGracePeriod(i.Data)
+				if limitReached && i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
+					s.suspendInstance(i, sp, i.Data, now)
+				} else if !limitReached && i.GetState().GetState() == statespb.NoCloudState_SUSPENDED && !suspendedManually {
+					s.publishInstanceStateAsync(&statespb.ObjectState{
 						Uuid: i.GetUuid(),
 						State: &statespb.State{
-							State: statespb.NoCloudState_SUSPENDED,
+							State: statespb.NoCloudState_RUNNING,
 						},
 					})
-					go s.HandlePublishEvent(&epb.Event{
+
+					s.publishEventAsync(&epb.Event{
 						Uuid: i.GetUuid(),
-						Key:  "instance_suspended",
+						Key:  "instance_unsuspended",
 						Data: map[string]*structpb.Value{},
 					})
 				}
-
-			} else if now <= lastMonitoringValue && i.GetState().GetState() == statespb.NoCloudState_SUSPENDED && !suspendedManually {
-				go s.HandlePublishInstanceState(&statespb.ObjectState{
-					Uuid: i.GetUuid(),
-					State: &statespb.State{
-						State: statespb.NoCloudState_RUNNING,
-					},
-				})
-
-				go s.HandlePublishEvent(&epb.Event{
-					Uuid: i.GetUuid(),
-					Key:  "instance_unsuspended",
-					Data: map[string]*structpb.Value{},
-				})
 			}
 			i.Data["next_payment_date"] = structpb.NewNumberValue(float64(lastMonitoringValue))
 		}
 
-		s._handleEvent(i)
+		s.handleTrialEnding(i, now)
+		s._handleEvent(i, addons, sp)
 		utils.SendActualMonitoringData(i.Data, i.Data, i.GetUuid(), s.HandlePublishInstanceData)
 	} else {
 		plan := i.BillingPlan
@@ -397,9 +507,11 @@ func (s *VirtualDriver) _handleNonRegularBilling(i *instances.Instance, addons m
 					priority = billing.Priority_NORMAL
 				}
 
-				recs, last := handleAddonBilling(log, i, lm, priority, addon)
+				storeAddonPeriod(i, addon, product)
+				period, _ := addonPeriod(addon, product)
+				recs, last := handleAddonBilling(log, i, lm, priority, addon, now)
 				if len(recs) > 0 {
-					if product.GetPeriod() == 0 {
+					if period == 0 {
 						if !ok {
 							records = append(records, recs...)
 							i.Data[fmt.Sprintf("addon_%s_last_monitoring", addonId)] = structpb.NewNumberValue(float64(last))
@@ -417,8 +529,12 @@ func (s *VirtualDriver) _handleNonRegularBilling(i *instances.Instance, addons m
 				last = int64(i.Data["last_monitoring"].GetNumberValue())
 				priority = billing.Priority_NORMAL
 			} else {
-				last = time.Now().Unix()
+				last = firstPaymentDate(i, now)
 				priority = billing.Priority_URGENT
+				if trial, end, started := s.handleTrial(log, i, product, last); started {
+					records = append(records, trial...)
+					last = end
+				}
 			}
 
 			if product.GetPeriod() == 0 {
@@ -427,7 +543,7 @@ func (s *VirtualDriver) _handleNonRegularBilling(i *instances.Instance, addons m
 					i.Data["last_monitoring"] = structpb.NewNumberValue(float64(last))
 				}
 			} else {
-				new, last := handleStaticBilling(log, i, last, priority)
+				new, last := handleStaticBilling(log, i, last, priority, now)
 				if len(new) != 0 {
 					records = append(records, new...)
 					i.Data["last_monitoring"] = structpb.NewNumberValue(float64(last))
@@ -441,15 +557,32 @@ func (s *VirtualDriver) _handleNonRegularBilling(i *instances.Instance, addons m
 			}
 		}
 
+		records, skipped = skipPayments(records, skip)
+		s.consumeSkippedPayments(log, i, skipped)
+		records = append(records, resourceRecords...)
+		applyDiscount(log, i, sp, records, now)
+		applyTax(instanceTax(i, sp), records)
+
 		log.Debug("Resulting billing", zap.Any("records", records))
 		s.HandlePublishRecords(records)
-		s._handleEvent(i)
+		s.handleTrialEnding(i, now)
+		s._handleEvent(i, addons, sp)
 		utils.SendActualMonitoringData(i.Data, i.Data, i.GetUuid(), s.HandlePublishInstanceData)
 	}
 }
 
-func (s *VirtualDriver) _handleRenewBilling(inst *instances.Instance) error {
+func (s *VirtualDriver) _handleRenewBilling(inst *instances.Instance, sp *sppb.ServicesProvider, params map[string]*structpb.Value) error {
 	log := s.log.Named("Manual renew")
+	addons, err := addonsFromParams(params)
+	if err != nil {
+		return err
+	}
+	// Addons are renewed at their own prices, so the definitions of all the attached ones are required
+	for _, addonId := range inst.GetAddons() {
+		if _, ok := addons[addonId]; !ok {
+			return fmt.Errorf("addon %s definition is not provided", addonId)
+		}
+	}
 	instData := inst.GetData()
 	instProduct := inst.GetProduct()
 	billingPlan := inst.GetBillingPlan()
@@ -484,20 +617,22 @@ func (s *VirtualDriver) _handleRenewBilling(inst *instances.Instance) error {
 	records = append(records, &billing.Record{
 		Start:    start,
 		End:      end,
-		Exec:     time.Now().Unix(),
+		Exec:     s.clock.Now().Unix(),
 		Priority: billing.Priority_URGENT,
 		Instance: inst.GetUuid(),
 		Product:  inst.GetProduct(),
 		Total:    1,
 	})
 	instData["last_monitoring"] = structpb.NewNumberValue(float64(end))
+	productEnd := end
 
 	prod, ok := inst.BillingPlan.Products[inst.GetProduct()]
 	if !ok {
 		log.Warn("Product not found", zap.String("product", *inst.Product))
 	}
 	for _, addonId := range inst.GetAddons() {
-		if prod.GetPeriod() == 0 {
+		period, periodKind := utils.StoredAddonPeriod(instData, addonId, prod)
+		if period == 0 {
 			continue
 		}
 		var (
@@ -509,17 +644,21 @@ func (s *VirtualDriver) _handleRenewBilling(inst *instances.Instance) error {
 		} else {
 			lm = int64(lmValue.GetNumberValue())
 		}
+		// Addons with own period are renewed only if they expire within renewed product period
+		if _, own := instData[fmt.Sprintf("addon_%s_period", addonId)]; own && lm >= productEnd {
+			continue
+		}
 
-		end = lm + prod.GetPeriod()
-		if product.GetPeriodKind() != billing.PeriodKind_DEFAULT {
-			end = utils.AlignPaymentDate(lm, end, prod.GetPeriod(), inst)
+		end = lm + period
+		if periodKind != billing.PeriodKind_DEFAULT {
+			end = utils.AlignPaymentDate(lm, end, period, inst)
 		}
 
 		inst.Data[fmt.Sprintf("addon_%s_last_monitoring", addonId)] = structpb.NewNumberValue(float64(end))
 		records = append(records, &billing.Record{
 			Start:    lm,
 			End:      end,
-			Exec:     time.Now().Unix(),
+			Exec:     s.clock.Now().Unix(),
 			Priority: billing.Priority_URGENT,
 			Instance: inst.GetUuid(),
 			Addon:    addonId,
@@ -527,26 +666,349 @@ func (s *VirtualDriver) _handleRenewBilling(inst *instances.Instance) error {
 		})
 	}
 
+	applyDiscount(log, inst, sp, records, s.clock.Now().Unix())
+
 	log.Debug("Final data", zap.Any("data", instData))
 	log.Debug("records", zap.Any("recs", records))
 
+	net, err := calculateRecordsPrice(records, addons, inst, s.currencyConverter(inst, sp))
+	if err != nil {
+		log.Error("Failed to calculate price", zap.Error(err))
+		return err
+	}
+
+	tax := instanceTax(inst, sp)
+	applyTax(tax, records)
 	s.HandlePublishRecords(records)
-	var price float64
-	for _, r := range records {
-		price += r.GetTotal()
+	eventData := map[string]*structpb.Value{
+		"price": structpb.NewNumberValue(tax.gross(net)),
+	}
+	if tax != nil {
+		eventData["tax"] = structpb.NewNumberValue(tax.amount(net))
+		for key, val := range tax.meta() {
+			eventData[key] = val
+		}
 	}
 	s.HandlePublishEvent(&epb.Event{
 		Type: "instance_renew",
 		Uuid: inst.GetUuid(),
+		Data: eventData,
+	})
+	utils.SendActualMonitoringData(instData, instData, inst.GetUuid(), s.HandlePublishInstanceData)
+	return nil
+}
+
+func (s *VirtualDriver) _handleChangeProduct(ctx context.Context, inst *instances.Instance, sp *sppb.ServicesProvider, params map[string]*structpb.Value) error {
+	log := s.log.Named("ChangeProduct").Named(inst.GetUuid())
+	instData := inst.GetData()
+	billingPlan := inst.GetBillingPlan()
+
+	if billingPlan.GetKind() != billing.PlanKind_STATIC {
+		return errors.New("not implemented for dynamic plan")
+	}
+
+	oldKey := inst.GetProduct()
+	newKey := params["product"].GetStringValue()
+	if newKey == "" || newKey == oldKey {
+		return errors.New("new product is not provided or same as current")
+	}
+
+	oldProduct, ok := billingPlan.GetProducts()[oldKey]
+	if !ok {
+		return errors.New("current product not found")
+	}
+	newProduct, ok := billingPlan.GetProducts()[newKey]
+	if !ok {
+		return fmt.Errorf("product %s not found", newKey)
+	}
+	if oldProduct.GetPeriod() == 0 || newProduct.GetPeriod() == 0 {
+		return errors.New("can't change one time product")
+	}
+
+	lastMonitoring, ok := instData["last_monitoring"]
+	if !ok {
+		return errors.New("no last monitoring")
+	}
+	lastMonitoringValue := int64(lastMonitoring.GetNumberValue())
+
+	now := s.clock.Now().Unix()
+	var records []*billing.Record
+
+	if oldProduct.GetKind() == billing.Kind_PREPAID {
+		// Credit time already paid for, but not used, at the discounted price it was paid
+		start := utils.PreviousPaymentDate(lastMonitoringValue, oldProduct.GetPeriod(), oldProduct.GetPeriodKind(), inst)
+		if unused := utils.Prorate(start, lastMonitoringValue, now) * paidFactor(instData, lastMonitoringValue); unused > 0 {
+			records = append(records, &billing.Record{
+				Start:    now,
+				End:      lastMonitoringValue,
+				Exec:     now,
+				Priority: billing.Priority_URGENT,
+				Instance: inst.GetUuid(),
+				Product:  oldKey,
+				Total:    -unused,
+			})
+		}
+	} else {
+		// Debit time used, but not paid yet
+		end := utils.NextPaymentDate(lastMonitoringValue, oldProduct.GetPeriod(), oldProduct.GetPeriodKind(), inst)
+		if used := 1 - utils.Prorate(lastMonitoringValue, end, now); used > 0 {
+			records = append(records, &billing.Record{
+				Start:    lastMonitoringValue,
+				End:      now,
+				Exec:     now,
+				Priority: billing.Priority_URGENT,
+				Instance: inst.GetUuid(),
+				Product:  oldKey,
+				Total:    used,
+			})
+		}
+	}
+
+	end := utils.NextPaymentDate(now, newProduct.GetPeriod(), newProduct.GetPeriodKind(), inst)
+	if newProduct.GetKind() == billing.Kind_PREPAID {
+		records = append(records, &billing.Record{
+			Start:    now,
+			End:      end,
+			Exec:     now,
+			Priority: billing.Priority_URGENT,
+			Instance: inst.GetUuid(),
+			Product:  newKey,
+			Total:    1,
+		})
+		instData["last_monitoring"] = structpb.NewNumberValue(float64(end))
+	} else {
+		instData["last_monitoring"] = structpb.NewNumberValue(float64(now))
+	}
+	instData["next_payment_date"] = structpb.NewNumberValue(float64(end))
+	delete(instData, "notification_period")
+
+	inst.Product = &newKey
+	if err := s.HandleUpdateInstance(ctx, inst); err != nil {
+		log.Error("Failed to update instance product", zap.Error(err))
+		return err
+	}
+
+	tax := instanceTax(inst, sp)
+	applyTax(tax, records)
+	log.Debug("records", zap.Any("recs", records))
+	s.HandlePublishRecords(records)
+
+	price, err := calculateRecordsPrice(records, nil, inst, s.currencyConverter(inst, sp))
+	if err != nil {
+		log.Warn("Failed to calculate price", zap.Error(err))
+	}
+	price = tax.gross(price)
+	s.HandlePublishEvent(&epb.Event{
+		Uuid: inst.GetUuid(),
+		Key:  "instance_product_changed",
 		Data: map[string]*structpb.Value{
-			"price": structpb.NewNumberValue(price),
+			"old_product": structpb.NewStringValue(oldKey),
+			"new_product": structpb.NewStringValue(newKey),
+			"price":       structpb.NewNumberValue(price),
 		},
 	})
 	utils.SendActualMonitoringData(instData, instData, inst.GetUuid(), s.HandlePublishInstanceData)
 	return nil
 }
 
-func (s *VirtualDriver) _handleEvent(i *instances.Instance) {
+func (s *VirtualDriver) _handleAttachAddon(ctx context.Context, inst *instances.Instance, sp *sppb.ServicesProvider, params map[string]*structpb.Value) error {
+	log := s.log.Named("AttachAddon").Named(inst.GetUuid())
+	if inst.Data == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+	instData := inst.GetData()
+
+	addonId := params["addon"].GetStringValue()
+	if addonId == "" {
+		return errors.New("addon is not provided")
+	}
+	if slices.Contains(inst.GetAddons(), addonId) {
+		return errors.New("addon is already attached")
+	}
+
+	product, ok := inst.GetBillingPlan().GetProducts()[inst.GetProduct()]
+	if !ok {
+		return errors.New("product not found")
+	}
+	addons, err := addonsFromParams(params)
+	if err != nil {
+		return err
+	}
+	addon, ok := addons[addonId]
+	if !ok {
+		return errors.New("addon definition is not provided")
+	}
+
+	now := s.clock.Now().Unix()
+	key := fmt.Sprintf("addon_%s_last_monitoring", addonId)
+	var records []*billing.Record
+
+	storeAddonPeriod(inst, addon, product)
+	period, periodKind := addonPeriod(addon, product)
+	priority := billing.Priority_URGENT
+	if addon.GetKind() == apb.Kind_POSTPAID {
+		priority = billing.Priority_NORMAL
+	}
+
+	if period == 0 {
+		records = append(records, &billing.Record{
+			Start: now, End: now + 1, Exec: now,
+			Priority: billing.Priority_URGENT,
+			Instance: inst.GetUuid(),
+			Addon:    addonId,
+			Total:    1,
+		})
+		instData[key] = structpb.NewNumberValue(float64(now))
+	} else if _, own := addon.GetMeta()["period"]; own {
+		// Addon with own period starts its period now, postpaid one is charged by Monitoring when it's over
+		end := utils.NextPaymentDate(now, period, periodKind, inst)
+		if addon.GetKind() == apb.Kind_POSTPAID {
+			end = now
+		} else {
+			records = append(records, &billing.Record{
+				Start:    now,
+				End:      end,
+				Exec:     now,
+				Priority: priority,
+				Instance: inst.GetUuid(),
+				Addon:    addonId,
+				Total:    1,
+			})
+		}
+		instData[key] = structpb.NewNumberValue(float64(end))
+	} else {
+		lastMonitoring, ok := instData["last_monitoring"]
+		if !ok {
+			return errors.New("no last monitoring")
+		}
+		lastMonitoringValue := int64(lastMonitoring.GetNumberValue())
+
+		// Addon is charged up to the end of current product period, so they renew together
+		var start, end int64
+		if product.GetKind() == billing.Kind_PREPAID {
+			start = utils.PreviousPaymentDate(lastMonitoringValue, product.GetPeriod(), product.GetPeriodKind(), inst)
+			end = lastMonitoringValue
+		} else {
+			start = lastMonitoringValue
+			end = utils.NextPaymentDate(lastMonitoringValue, product.GetPeriod(), product.GetPeriodKind(), inst)
+		}
+
+		if fraction := utils.Prorate(start, end, now); fraction > 0 {
+			records = append(records, &billing.Record{
+				Start:    now,
+				End:      end,
+				Exec:     now,
+				Priority: priority,
+				Instance: inst.GetUuid(),
+				Addon:    addonId,
+				Total:    fraction,
+			})
+		}
+		instData[key] = structpb.NewNumberValue(float64(end))
+	}
+
+	inst.Addons = append(inst.Addons, addonId)
+	if err := s.HandleUpdateInstance(ctx, inst); err != nil {
+		log.Error("Failed to update instance addons", zap.Error(err))
+		return err
+	}
+
+	applyTax(instanceTax(inst, sp), records)
+	log.Debug("records", zap.Any("recs", records))
+	s.HandlePublishRecords(records)
+	s.HandlePublishEvent(&epb.Event{
+		Uuid: inst.GetUuid(),
+		Key:  "addon_attached",
+		Data: map[string]*structpb.Value{
+			"addon": structpb.NewStringValue(addonId),
+		},
+	})
+	utils.SendActualMonitoringData(instData, instData, inst.GetUuid(), s.HandlePublishInstanceData)
+	return nil
+}
+
+func (s *VirtualDriver) _handleDetachAddon(ctx context.Context, inst *instances.Instance, sp *sppb.ServicesProvider, params map[string]*structpb.Value) error {
+	log := s.log.Named("DetachAddon").Named(inst.GetUuid())
+	instData := inst.GetData()
+
+	addonId := params["addon"].GetStringValue()
+	if !slices.Contains(inst.GetAddons(), addonId) {
+		return errors.New("addon is not attached")
+	}
+
+	product := inst.GetBillingPlan().GetProducts()[inst.GetProduct()]
+	addons, err := addonsFromParams(params)
+	if err != nil {
+		return err
+	}
+	addon, ok := addons[addonId]
+	if !ok {
+		return errors.New("addon definition is not provided")
+	}
+
+	now := s.clock.Now().Unix()
+	key := fmt.Sprintf("addon_%s_last_monitoring", addonId)
+	var records []*billing.Record
+
+	period, periodKind := addonPeriod(addon, product)
+	if lmValue, ok := instData[key]; ok && period > 0 {
+		lm := int64(lmValue.GetNumberValue())
+		if addon.GetKind() == apb.Kind_PREPAID {
+			// Credit time already paid for, but not used. Discounts apply to products only, so addons are paid in full
+			start := utils.PreviousPaymentDate(lm, period, periodKind, inst)
+			if unused := utils.Prorate(start, lm, now); unused > 0 {
+				records = append(records, &billing.Record{
+					Start:    now,
+					End:      lm,
+					Exec:     now,
+					Priority: billing.Priority_URGENT,
+					Instance: inst.GetUuid(),
+					Addon:    addonId,
+					Total:    -unused,
+				})
+			}
+		} else {
+			// Debit time used, but not paid yet
+			end := utils.NextPaymentDate(lm, period, periodKind, inst)
+			if used := 1 - utils.Prorate(lm, end, now); used > 0 {
+				records = append(records, &billing.Record{
+					Start:    lm,
+					End:      now,
+					Exec:     now,
+					Priority: billing.Priority_URGENT,
+					Instance: inst.GetUuid(),
+					Addon:    addonId,
+					Total:    used,
+				})
+			}
+		}
+	}
+	delete(instData, key)
+	delete(instData, fmt.Sprintf("addon_%s_notification_period", addonId))
+	delete(instData, fmt.Sprintf("addon_%s_period", addonId))
+	delete(instData, fmt.Sprintf("addon_%s_period_kind", addonId))
+
+	inst.Addons = slices.DeleteFunc(inst.Addons, func(a string) bool { return a == addonId })
+	if err := s.HandleUpdateInstance(ctx, inst); err != nil {
+		log.Error("Failed to update instance addons", zap.Error(err))
+		return err
+	}
+
+	applyTax(instanceTax(inst, sp), records)
+	log.Debug("records", zap.Any("recs", records))
+	s.HandlePublishRecords(records)
+	s.HandlePublishEvent(&epb.Event{
+		Uuid: inst.GetUuid(),
+		Key:  "addon_detached",
+		Data: map[string]*structpb.Value{
+			"addon": structpb.NewStringValue(addonId),
+		},
+	})
+	utils.SendActualMonitoringData(instData, instData, inst.GetUuid(), s.HandlePublishInstanceData)
+	return nil
+}
+
+func (s *VirtualDriver) _handleEvent(i *instances.Instance, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) {
 	log := s.log.Named("BusEvent").Named(i.GetUuid())
 	log.Debug("Get event", zap.String("uuid", i.GetUuid()))
 	if i.GetStatus() == statusespb.NoCloudStatus_DEL {
@@ -554,7 +1016,7 @@ func (s *VirtualDriver) _handleEvent(i *instances.Instance) {
 	}
 
 	data := i.GetData()
-	now := time.Now().Unix()
+	now := s.clock.Now().Unix()
 
 	last_monitoring, ok := data["last_monitoring"]
 	if !ok {
@@ -568,7 +1030,8 @@ func (s *VirtualDriver) _handleEvent(i *instances.Instance) {
 	products := i.GetBillingPlan().GetProducts()
 	product, ok := products[productName]
 
-	if !ok {
+	// One-time products never expire
+	if !ok || product.GetPeriod() == 0 {
 		return
 	}
 
@@ -588,49 +1051,66 @@ func (s *VirtualDriver) _handleEvent(i *instances.Instance) {
 
 	log.Debug("Diff", zap.Any("d", diff))
 
-	unix := time.Unix(expirationDate, 0)
-	year, month, day := unix.Date()
-	for _, val := range notificationsPeriods {
-		if diff <= val.Timestamp {
+	periods := notificationPeriods(i, product, sp)
+	s.notifyExpiry(i, "notification_period", diff, expirationDate, periods, map[string]*structpb.Value{
+		"product": structpb.NewStringValue(i.GetProduct()),
+	})
 
-			if val.Timestamp == period {
-				break
-			}
+	for _, addonId := range i.GetAddons() {
+		lmValue, ok := data[fmt.Sprintf("addon_%s_last_monitoring", addonId)]
+		if !ok {
+			continue
+		}
+		addon, ok := addons[addonId]
+		if !ok {
+			log.Debug("Addon not found", zap.String("addon", addonId))
+			continue
+		}
 
-			notification_period, ok := data["notification_period"]
-			if !ok {
-				data["notification_period"] = structpb.NewNumberValue(float64(val.Days))
-				go s.HandlePublishEvent(&epb.Event{
-					Uuid: i.GetUuid(),
-					Key:  "expiry_notification",
-					Data: map[string]*structpb.Value{
-						"period":  structpb.NewNumberValue(float64(val.Days)),
-						"product": structpb.NewStringValue(i.GetProduct()),
-						"date":    structpb.NewStringValue(fmt.Sprintf("%d/%d/%d", day, month, year)),
-					},
-				})
-				continue
-			}
+		// One-time addons never expire
+		addonPeriod, _ := addonPeriod(addon, product)
+		if addonPeriod == 0 {
+			continue
+		}
 
-			if val.Days != int64(notification_period.GetNumberValue()) {
-				data["notification_period"] = structpb.NewNumberValue(float64(val.Days))
-				go s.HandlePublishEvent(&epb.Event{
-					Uuid: i.GetUuid(),
-					Key:  "expiry_notification",
-					Data: map[string]*structpb.Value{
-						"period":  structpb.NewNumberValue(float64(val.Days)),
-						"product": structpb.NewStringValue(i.GetProduct()),
-						"date":    structpb.NewStringValue(fmt.Sprintf("%d/%d/%d", day, month, year)),
-					},
-				})
-			}
-			break
+		expirationDate := int64(lmValue.GetNumberValue())
+		if addon.GetKind() == apb.Kind_POSTPAID {
+			expirationDate += addonPeriod
 		}
+		s.notifyExpiry(i, fmt.Sprintf("addon_%s_notification_period", addonId), expirationDate-now, expirationDate, periods, map[string]*structpb.Value{
+			"product":     structpb.NewStringValue(i.GetProduct()),
+			"addon":       structpb.NewStringValue(addonId),
+			"addon_title": structpb.NewStringValue(addon.GetTitle()),
+		})
 	}
 	log.Debug("Data", zap.Any("d", data))
 	i.Data = data
 }
 
+// notifyExpiry publishes expiry_notification once per notification period, the last one sent is stored in instance data by key
+func (s *VirtualDriver) notifyExpiry(i *instances.Instance, key string, diff int64, expirationDate int64, periods []ExpiryDiff, eventData map[string]*structpb.Value) {
+	year, month, day := time.Unix(expirationDate, 0).Date()
+	for _, val := range periods {
+		if diff > val.Timestamp {
+			continue
+		}
+
+		if notificationPeriod, ok := i.Data[key]; ok && val.Days == int64(notificationPeriod.GetNumberValue()) {
+			break
+		}
+
+		i.Data[key] = structpb.NewNumberValue(float64(val.Days))
+		eventData["period"] = structpb.NewNumberValue(float64(val.Days))
+		eventData["date"] = structpb.NewStringValue(fmt.Sprintf("%d/%d/%d", day, month, year))
+		s.publishEventAsync(&epb.Event{
+			Uuid: i.GetUuid(),
+			Key:  "expiry_notification",
+			Data: eventData,
+		})
+		break
+	}
+}
+
 func handleOneTimePayment(log *zap.Logger, i *instances.Instance, last int64, priority billing.Priority) []*billing.Record {
 	log.Debug("Handling Static Billing", zap.Int64("last", last))
 	log.Debug("instance body", zap.Any("body", i))
@@ -653,7 +1133,7 @@ func handleOneTimePayment(log *zap.Logger, i *instances.Instance, last int64, pr
 	return records
 }
 
-func handleStaticBilling(log *zap.Logger, i *instances.Instance, last int64, priority billing.Priority) ([]*billing.Record, int64) {
+func handleStaticBilling(log *zap.Logger, i *instances.Instance, last int64, priority billing.Priority, now int64) ([]*billing.Record, int64) {
 	log.Debug("Handling Static Billing", zap.Int64("last", last))
 	product, ok := i.BillingPlan.Products[*i.Product]
 	if !ok {
@@ -664,10 +1144,7 @@ func handleStaticBilling(log *zap.Logger, i *instances.Instance, last int64, pri
 	var records []*billing.Record
 	if product.Kind == billing.Kind_POSTPAID {
 		log.Debug("Handling Postpaid Billing", zap.Any("product", product))
-		for end := last + product.Period; end <= time.Now().Unix(); end += product.Period {
-			if product.GetPeriodKind() != billing.PeriodKind_DEFAULT {
-				end = utils.AlignPaymentDate(last, end, product.GetPeriod(), i)
-			}
+		for end := utils.NextPaymentDate(last, product.GetPeriod(), product.GetPeriodKind(), i); end <= now; end = utils.NextPaymentDate(last, product.GetPeriod(), product.GetPeriodKind(), i) {
 			records = append(records, &billing.Record{
 				Product:  *i.Product,
 				Instance: i.GetUuid(),
@@ -675,11 +1152,12 @@ func handleStaticBilling(log *zap.Logger, i *instances.Instance, last int64, pri
 				Priority: billing.Priority_NORMAL,
 				Total:    1,
 			})
+			last = end
 		}
 	} else {
 		end := last + product.Period
-		log.Debug("Handling Prepaid Billing", zap.Any("product", product), zap.Int64("end", end), zap.Int64("now", time.Now().Unix()))
-		for ; last <= time.Now().Unix(); end += product.Period {
+		log.Debug("Handling Prepaid Billing", zap.Any("product", product), zap.Int64("end", end), zap.Int64("now", now))
+		for ; last <= now; end += product.Period {
 			if product.GetPeriodKind() != billing.PeriodKind_DEFAULT {
 				end = utils.AlignPaymentDate(last, end, product.GetPeriod(), i)
 			}
@@ -697,39 +1175,159 @@ func handleStaticBilling(log *zap.Logger, i *instances.Instance, last int64, pri
 	return records, last
 }
 
-func handleOneTimeResourcePayment(log *zap.Logger, i *instances.Instance, res *billing.ResourceConf, last int64) []*billing.Record {
+func handleResourcesBilling(log *zap.Logger, i *instances.Instance, now int64) []*billing.Record {
+	var records []*billing.Record
+
+	for _, res := range i.GetBillingPlan().GetResources() {
+		// Metered resources are billed by reported usage only
+		if utils.ResourceMetered(res) {
+			records = append(records, handleUsageBilling(log, i, res, now)...)
+			continue
+		}
+
+		amount, ok := i.GetResources()[res.GetKey()]
+		if !ok {
+			continue
+		}
+
+		key := fmt.Sprintf("%s_last_monitoring", res.GetKey())
+		lmValue, ok := i.Data[key]
+
+		// Time spent in states the resource isn't billed in is not charged, one-time resources are charged once it's active
+		if !utils.ResourceActive(res, i.GetState().GetState()) {
+			log.Debug("Resource is not billed in current state", zap.String("resource", res.GetKey()), zap.String("state", i.GetState().GetState().String()))
+			if res.GetPeriod() != 0 && int64(lmValue.GetNumberValue()) < now {
+				i.Data[key] = structpb.NewNumberValue(float64(now))
+			}
+			continue
+		}
+
+		if res.GetPeriod() == 0 {
+			if !ok {
+				records = append(records, handleOneTimeResourcePayment(log, i, res, amount.GetNumberValue(), firstPaymentDate(i, now))...)
+				i.Data[key] = structpb.NewNumberValue(float64(now))
+			}
+			continue
+		}
+
+		var last int64
+		if ok {
+			last = int64(lmValue.GetNumberValue())
+		} else {
+			last = now
+		}
+
+		recs, last := handleCapacityBilling(log, i, res, amount.GetNumberValue(), last, now)
+		records = append(records, recs...)
+		i.Data[key] = structpb.NewNumberValue(float64(last))
+	}
+
+	return records
+}
+
+// pauseResourcesBilling moves last monitoring of periodic resources to now, so time before it is never charged.
+// Resources paid in advance keep their last monitoring
+func pauseResourcesBilling(i *instances.Instance, now int64) {
+	for _, res := range i.GetBillingPlan().GetResources() {
+		if _, ok := i.GetResources()[res.GetKey()]; !ok || res.GetPeriod() == 0 || utils.ResourceMetered(res) {
+			continue
+		}
+		key := fmt.Sprintf("%s_last_monitoring", res.GetKey())
+		if int64(i.Data[key].GetNumberValue()) < now {
+			i.Data[key] = structpb.NewNumberValue(float64(now))
+		}
+	}
+}
+
+// firstPaymentDate returns the start of the first payment of an item. It's the time instance was started or created,
+// so the first records are the same if billing is repeated
+func firstPaymentDate(i *instances.Instance, now int64) int64 {
+	if started := i.GetMeta().GetStarted(); started > 0 {
+		return started
+	}
+	if i.GetCreated() > 0 {
+		return i.GetCreated()
+	}
+	return now
+}
+
+// productExpired reports whether the period paid by last monitoring is over. One-time products never expire
+func productExpired(product *billing.Product, last int64, now int64) bool {
+	if product.GetPeriod() == 0 {
+		return false
+	}
+	if product.GetKind() == billing.Kind_POSTPAID {
+		return now > last+product.GetPeriod()
+	}
+	return now > last
+}
+
+func handleUsageBilling(log *zap.Logger, i *instances.Instance, res *billing.ResourceConf, now int64) []*billing.Record {
+	usageKey := fmt.Sprintf("%s_usage", res.GetKey())
+	startKey := fmt.Sprintf("%s_usage_start", res.GetKey())
+	endKey := fmt.Sprintf("%s_usage_end", res.GetKey())
+
+	usage := i.Data[usageKey].GetNumberValue()
+	if usage <= 0 {
+		return nil
+	}
+	log.Debug("Handling Usage Billing", zap.String("resource", res.GetKey()), zap.Float64("usage", usage))
+
+	// Record spans reports, so it's the same if billing is repeated
+	start, end := now, now
+	if startValue, ok := i.Data[startKey]; ok {
+		start = int64(startValue.GetNumberValue())
+		end = start
+	}
+	if endValue, ok := i.Data[endKey]; ok {
+		end = int64(endValue.GetNumberValue())
+	}
+	delete(i.Data, usageKey)
+	delete(i.Data, startKey)
+	delete(i.Data, endKey)
+
+	return []*billing.Record{{
+		Resource: res.GetKey(),
+		Instance: i.GetUuid(),
+		Start:    start, End: end, Exec: now,
+		Priority: billing.Priority_NORMAL,
+		Total:    usage,
+	}}
+}
+
+func handleOneTimeResourcePayment(log *zap.Logger, i *instances.Instance, res *billing.ResourceConf, amount float64, last int64) []*billing.Record {
+	log.Debug("Handling One Time Resource Payment", zap.String("resource", res.GetKey()), zap.Int64("last", last))
 	var records []*billing.Record
 
 	records = append(records, &billing.Record{
 		Resource: res.Key,
 		Instance: i.GetUuid(),
 		Start:    last, End: last + 1,
-		Exec:  last,
-		Total: 1,
+		Exec:     last,
+		Priority: billing.Priority_URGENT,
+		Total:    amount,
 	})
 
 	return records
 }
 
-func handleCapacityBilling(log *zap.Logger, i *instances.Instance, res *billing.ResourceConf, last int64) ([]*billing.Record, int64) {
+func handleCapacityBilling(log *zap.Logger, i *instances.Instance, res *billing.ResourceConf, amount float64, last int64, now int64) ([]*billing.Record, int64) {
+	log.Debug("Handling Capacity Billing", zap.String("resource", res.GetKey()), zap.Int64("last", last))
 	var records []*billing.Record
 
 	if res.Kind == billing.Kind_POSTPAID {
-		for end := last + res.Period; end <= time.Now().Unix(); end += res.Period {
-			if res.GetPeriodKind() != billing.PeriodKind_DEFAULT {
-				end = utils.AlignPaymentDate(last, end, res.GetPeriod(), i)
-			}
+		for end := utils.NextPaymentDate(last, res.GetPeriod(), res.GetPeriodKind(), i); end <= now; end = utils.NextPaymentDate(last, res.GetPeriod(), res.GetPeriodKind(), i) {
 			records = append(records, &billing.Record{
 				Resource: res.Key,
 				Instance: i.GetUuid(),
 				Start:    last, End: end,
 				Exec:  last,
-				Total: 1,
+				Total: amount,
 			})
 			last = end
 		}
 	} else {
-		for end := last + res.Period; last <= time.Now().Unix(); end += res.Period {
+		for end := last + res.Period; last <= now; end += res.Period {
 			if res.GetPeriodKind() != billing.PeriodKind_DEFAULT {
 				end = utils.AlignPaymentDate(last, end, res.GetPeriod(), i)
 			}
@@ -738,7 +1336,7 @@ func handleCapacityBilling(log *zap.Logger, i *instances.Instance, res *billing.
 				Instance: i.GetUuid(),
 				Priority: billing.Priority_URGENT,
 				Start:    last, End: end, Exec: last,
-				Total: 1,
+				Total: amount,
 			})
 			last = end
 		}
@@ -747,14 +1345,14 @@ func handleCapacityBilling(log *zap.Logger, i *instances.Instance, res *billing.
 	return records, last
 }
 
-func handleAddonBilling(log *zap.Logger, i *instances.Instance, last int64, priority billing.Priority, addon *apb.Addon) ([]*billing.Record, int64) {
+func handleAddonBilling(log *zap.Logger, i *instances.Instance, last int64, priority billing.Priority, addon *apb.Addon, now int64) ([]*billing.Record, int64) {
 	log.Debug("Handling Addon Billing", zap.Int64("last", last))
 	product, ok := i.BillingPlan.Products[i.GetProduct()]
 	if !ok {
 		log.Warn("Product not found", zap.String("product", *i.Product), zap.String("addon", addon.GetUuid()))
 		return nil, last
 	}
-	period := product.Period
+	period, periodKind := addonPeriod(addon, product)
 
 	var records []*billing.Record
 
@@ -773,12 +1371,7 @@ func handleAddonBilling(log *zap.Logger, i *instances.Instance, last int64, prio
 	// Handle periodic addon payment
 	if addon.Kind == apb.Kind_POSTPAID {
 		log.Debug("Handling Postpaid Billing", zap.Any("addon", addon.GetUuid()))
-		for end := last + period; end <= time.Now().Unix(); end += period {
-
-			if product.GetPeriodKind() != billing.PeriodKind_DEFAULT {
-				end = utils.AlignPaymentDate(last, end, period, i)
-			}
-
+		for end := utils.NextPaymentDate(last, period, periodKind, i); end <= now; end = utils.NextPaymentDate(last, period, periodKind, i) {
 			records = append(records, &billing.Record{
 				Addon:    addon.GetUuid(),
 				Instance: i.GetUuid(),
@@ -786,13 +1379,14 @@ func handleAddonBilling(log *zap.Logger, i *instances.Instance, last int64, prio
 				Priority: billing.Priority_NORMAL,
 				Total:    1,
 			})
+			last = end
 		}
 	} else {
 		end := last + period
-		log.Debug("Handling Prepaid Billing", zap.Any("addon", addon.GetUuid()), zap.Int64("end", end), zap.Int64("now", time.Now().Unix()))
-		for ; last <= time.Now().Unix(); end += period {
-			if product.GetPeriodKind() != billing.PeriodKind_DEFAULT {
-				end = utils.AlignPaymentDate(last, end, product.Period, i)
+		log.Debug("Handling Prepaid Billing", zap.Any("addon", addon.GetUuid()), zap.Int64("end", end), zap.Int64("now", now))
+		for ; last <= now; end += period {
+			if periodKind != billing.PeriodKind_DEFAULT {
+				end = utils.AlignPaymentDate(last, end, period, i)
 			}
 			records = append(records, &billing.Record{
 				Addon:    addon.GetUuid(),
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud-proto/instances"
+	stpb "github.com/slntopp/nocloud-proto/states"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func unix(year int, month time.Month, day int) int64 {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix()
+}
+
+func TestPostpaidCapacityBillingCalendarMonth(t *testing.T) {
+	inst := &instances.Instance{Uuid: "inst", Created: unix(2026, 1, 31)}
+	res := &billing.ResourceConf{
+		Key:        "cpu",
+		Kind:       billing.Kind_POSTPAID,
+		Period:     30 * 86400,
+		PeriodKind: billing.PeriodKind_CALENDAR_MONTH,
+	}
+
+	tests := []struct {
+		name string
+		now  int64
+		ends []int64
+	}{
+		{"before period end", unix(2026, 2, 27), nil},
+		{"february end", unix(2026, 2, 28), []int64{unix(2026, 2, 28)}},
+		{"march 2 isn't march end", unix(2026, 3, 2), []int64{unix(2026, 2, 28)}},
+		{"day before march end", unix(2026, 3, 30), []int64{unix(2026, 2, 28)}},
+		{"march end", unix(2026, 3, 31), []int64{unix(2026, 2, 28), unix(2026, 3, 31)}},
+		{"april end", unix(2026, 4, 30), []int64{unix(2026, 2, 28), unix(2026, 3, 31), unix(2026, 4, 30)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, last := handleCapacityBilling(zap.NewNop(), inst, res, 2, unix(2026, 1, 31), tt.now)
+			if len(records) != len(tt.ends) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.ends))
+			}
+			start := unix(2026, 1, 31)
+			for n, rec := range records {
+				if rec.GetStart() != start || rec.GetEnd() != tt.ends[n] {
+					t.Errorf("record %d is %v - %v, want %v - %v", n,
+						time.Unix(rec.GetStart(), 0).UTC(), time.Unix(rec.GetEnd(), 0).UTC(),
+						time.Unix(start, 0).UTC(), time.Unix(tt.ends[n], 0).UTC())
+				}
+				if rec.GetTotal() != 2 {
+					t.Errorf("record %d total = %v, want 2", n, rec.GetTotal())
+				}
+				start = rec.GetEnd()
+			}
+			if last != start {
+				t.Errorf("last = %v, want %v", time.Unix(last, 0).UTC(), time.Unix(start, 0).UTC())
+			}
+		})
+	}
+}
+
+func TestChangeProductCreditsDiscountedPrice(t *testing.T) {
+	lm := unix(2026, 3, 31)
+	product := "small"
+	inst := &instances.Instance{
+		Uuid:    "inst",
+		Product: &product,
+		BillingPlan: &billing.Plan{
+			Kind: billing.PlanKind_STATIC,
+			Products: map[string]*billing.Product{
+				"small": {Kind: billing.Kind_PREPAID, Price: 10, Period: 30 * 86400},
+				"large": {Kind: billing.Kind_PREPAID, Price: 20, Period: 30 * 86400},
+			},
+		},
+		Data: map[string]*structpb.Value{
+			"last_monitoring":     structpb.NewNumberValue(float64(lm)),
+			"discount_factor":     structpb.NewNumberValue(0.5),
+			"discount_period_end": structpb.NewNumberValue(float64(lm)),
+		},
+	}
+
+	// Half of the period is left unused
+	s, published := testDriver(utils.NewFakeClock(time.Unix(lm-15*86400, 0)))
+	params := map[string]*structpb.Value{"product": structpb.NewStringValue("large")}
+	if err := s._handleChangeProduct(context.Background(), inst, nil, params); err != nil {
+		t.Fatalf("_handleChangeProduct: %v", err)
+	}
+
+	for _, rec := range published() {
+		if rec.GetProduct() == "small" {
+			if math.Abs(rec.GetTotal()+0.25) > 1e-9 {
+				t.Errorf("credit total = %v, want -0.25", rec.GetTotal())
+			}
+			return
+		}
+	}
+	t.Error("unused time isn't credited")
+}
+
+func TestFirstPaymentIdempotencyKey(t *testing.T) {
+	created := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	product := "month"
+	newInstance := func() *instances.Instance {
+		return &instances.Instance{
+			Uuid:    "inst",
+			Created: created.Unix(),
+			Product: &product,
+			BillingPlan: &billing.Plan{
+				Kind: billing.PlanKind_STATIC,
+				Products: map[string]*billing.Product{
+					product: {Kind: billing.Kind_PREPAID, Price: 10, Period: 30 * 86400},
+				},
+				Resources: []*billing.ResourceConf{
+					{Key: "setup", Kind: billing.Kind_PREPAID, Price: 5},
+				},
+			},
+			Resources: map[string]*structpb.Value{"setup": structpb.NewNumberValue(1)},
+		}
+	}
+	keys := func(records []*billing.Record) map[string]string {
+		keys := make(map[string]string)
+		for _, rec := range records {
+			keys[rec.GetProduct()+rec.GetResource()] = utils.RecordIdempotencyKey(rec)
+		}
+		return keys
+	}
+
+	// Tick repeated later, e.g. by another replica, before the first one stored instance data
+	first, firstRecords := testDriver(utils.NewFakeClock(created.Add(time.Minute)))
+	first._handleInstanceBilling(newInstance(), newLedger(100), nil, nil)
+	retry, retryRecords := testDriver(utils.NewFakeClock(created.Add(7 * time.Minute)))
+	retry._handleInstanceBilling(newInstance(), newLedger(100), nil, nil)
+
+	want, got := keys(firstRecords()), keys(retryRecords())
+	for _, item := range []string{product, "setup"} {
+		if want[item] == "" || got[item] != want[item] {
+			t.Errorf("%s first payment keys differ: %q and %q", item, want[item], got[item])
+		}
+	}
+}
+
+func TestUsageBilledAfterStateChange(t *testing.T) {
+	reported := unix(2026, 3, 1)
+	res := &billing.ResourceConf{
+		Key:  "traffic",
+		On:   []stpb.NoCloudState{stpb.NoCloudState_RUNNING},
+		Meta: map[string]*structpb.Value{"metered": structpb.NewBoolValue(true)},
+	}
+	// Usage was reported while running, instance is suspended before billing
+	inst := &instances.Instance{
+		Uuid:  "inst",
+		State: &stpb.State{State: stpb.NoCloudState_SUSPENDED},
+		Data: map[string]*structpb.Value{
+			"traffic_usage":       structpb.NewNumberValue(5),
+			"traffic_usage_start": structpb.NewNumberValue(float64(reported)),
+		},
+	}
+
+	records := handleUsageBilling(zap.NewNop(), inst, res, reported+3600)
+	if len(records) != 1 || records[0].GetTotal() != 5 {
+		t.Fatalf("got records %v, want usage of 5 billed", records)
+	}
+	if _, ok := inst.Data["traffic_usage"]; ok {
+		t.Error("billed usage isn't cleared")
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	discountPercent = "percent"
+	discountFixed   = "fixed"
+)
+
+// Discount is read from SP secrets promocodes or billing plan meta, e.g.
+// {"type": "percent", "value": 10, "expires": 1767225600, "periods": 3}
+// Zero expires and periods mean no limit
+type Discount struct {
+	Source  string
+	Type    string
+	Value   float64
+	Expires int64
+	Periods int64
+}
+
+func discountFromValue(source string, val *structpb.Value) *Discount {
+	fields := val.GetStructValue().GetFields()
+	if fields == nil {
+		return nil
+	}
+	d := &Discount{
+		Source:  source,
+		Type:    fields["type"].GetStringValue(),
+		Value:   fields["value"].GetNumberValue(),
+		Expires: int64(fields["expires"].GetNumberValue()),
+		Periods: int64(fields["periods"].GetNumberValue()),
+	}
+	if d.Type == "" {
+		d.Type = discountPercent
+	}
+	if d.Value <= 0 || (d.Type != discountPercent && d.Type != discountFixed) {
+		return nil
+	}
+	return d
+}
+
+// instanceDiscount returns discount from instance promocode if any, falling back to the billing plan one
+func instanceDiscount(i *instances.Instance, sp *sppb.ServicesProvider) *Discount {
+	if code := i.GetConfig()["promocode"].GetStringValue(); code != "" {
+		promo := sp.GetSecrets()["promocodes"].GetStructValue().GetFields()[code]
+		if d := discountFromValue("promocode:"+code, promo); d != nil {
+			return d
+		}
+	}
+	return discountFromValue("plan", i.GetBillingPlan().GetMeta()["discount"])
+}
+
+// factor returns the part of price left to pay
+func (d *Discount) factor(price float64) float64 {
+	if d.Type == discountPercent {
+		return max(0, 1-d.Value/100)
+	}
+	if price <= 0 {
+		return 1
+	}
+	return max(0, (price-d.Value)/price)
+}
+
+// applyDiscount lowers the totals of product records while the instance discount is active and counts discounted periods in instance data
+func applyDiscount(log *zap.Logger, i *instances.Instance, sp *sppb.ServicesProvider, records []*billing.Record, now int64) {
+	d := instanceDiscount(i, sp)
+	if d == nil {
+		return
+	}
+	if d.Expires > 0 && now > d.Expires {
+		log.Debug("Discount expired", zap.String("source", d.Source))
+		return
+	}
+
+	if i.Data["discount_source"].GetStringValue() != d.Source {
+		i.Data["discount_source"] = structpb.NewStringValue(d.Source)
+		i.Data["discount_periods_used"] = structpb.NewNumberValue(0)
+	}
+	used := int64(i.Data["discount_periods_used"].GetNumberValue())
+
+	for _, rec := range records {
+		if rec.GetProduct() == "" || rec.GetTotal() <= 0 {
+			continue
+		}
+		if d.Periods > 0 && used >= d.Periods {
+			break
+		}
+
+		price := i.GetBillingPlan().GetProducts()[rec.GetProduct()].GetPrice()
+		factor := d.factor(price)
+
+		if rec.Meta == nil {
+			rec.Meta = make(map[string]*structpb.Value)
+		}
+		rec.Meta["discount_source"] = structpb.NewStringValue(d.Source)
+		rec.Meta["discount_type"] = structpb.NewStringValue(d.Type)
+		rec.Meta["discount_value"] = structpb.NewNumberValue(d.Value)
+		rec.Meta["discount_amount"] = structpb.NewNumberValue(price * rec.GetTotal() * (1 - factor))
+		rec.Total *= factor
+		used++
+
+		// Refunds of the period are prorated from the discounted price
+		i.Data["discount_factor"] = structpb.NewNumberValue(factor)
+		i.Data["discount_period_end"] = structpb.NewNumberValue(float64(rec.GetEnd()))
+	}
+
+	log.Debug("Discount applied", zap.String("source", d.Source), zap.Int64("periods_used", used))
+	i.Data["discount_periods_used"] = structpb.NewNumberValue(float64(used))
+}
+
+// paidFactor returns the part of product price paid for the period ending at end, it's less than 1 if the period was discounted
+func paidFactor(data map[string]*structpb.Value, end int64) float64 {
+	factor, ok := data["discount_factor"]
+	if !ok || int64(data["discount_period_end"].GetNumberValue()) != end {
+		return 1
+	}
+	return factor.GetNumberValue()
+}
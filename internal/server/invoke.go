@@ -29,18 +29,30 @@ func (s *VirtualDriver) Invoke(ctx context.Context, req *pb.InvokeRequest) (*ipb
 
 	action, ok := actions.SrvActions[method]
 	if ok {
-		return action(log, s.HandlePublishInstanceState, s.HandlePublishInstanceData, instance, req.GetParams())
+		return action(log, s.clock, s.HandlePublishInstanceState, s.HandlePublishInstanceData, instance, req.GetParams())
 	}
 
 	action, ok = actions.BillingActions[method]
 	if ok {
-		if method == "manual_renew" {
-			err := s._handleRenewBilling(instance)
-			if err != nil {
-				return &ipb.InvokeResponse{Result: false}, err
-			}
-		} else {
-			return action(log, s.HandlePublishInstanceState, s.HandlePublishInstanceData, instance, req.GetParams())
+		var err error
+		switch method {
+		case "manual_renew":
+			err = s._handleRenewBilling(instance, sp, req.GetParams())
+		case "change_product":
+			err = s._handleChangeProduct(ctx, instance, sp, req.GetParams())
+		case "attach_addon":
+			err = s._handleAttachAddon(ctx, instance, sp, req.GetParams())
+		case "detach_addon":
+			err = s._handleDetachAddon(ctx, instance, sp, req.GetParams())
+		case "preview_billing":
+			return s._handleBillingPreview(instance, sp, req.GetParams())
+		case "refund":
+			return s._handleRefund(instance, sp, req.GetParams())
+		default:
+			return action(log, s.clock, s.HandlePublishInstanceState, s.HandlePublishInstanceData, instance, req.GetParams())
+		}
+		if err != nil {
+			return &ipb.InvokeResponse{Result: false}, err
 		}
 		return &ipb.InvokeResponse{Result: true}, nil
 	}
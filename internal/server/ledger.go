@@ -0,0 +1,71 @@
+package server
+
+import (
+	"cmp"
+	"sync"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+)
+
+// ledger is the balance of instances group account, safe for concurrent use
+type ledger struct {
+	mu      sync.Mutex
+	balance float64
+}
+
+func newLedger(balance float64) *ledger {
+	return &ledger{balance: balance}
+}
+
+// reserve takes amount from the balance if it is sufficient, balance may go below zero down to -creditLimit.
+// Returns the part of amount taken on credit
+func (l *ledger) reserve(amount float64, creditLimit float64) (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if amount > l.balance+max(creditLimit, 0) {
+		return 0, false
+	}
+	credit := amount - max(min(l.balance, amount), 0)
+	l.balance -= amount
+	return credit, true
+}
+
+func (l *ledger) Balance() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.balance
+}
+
+// instanceExpiry returns date the instance is paid until
+func instanceExpiry(i *ipb.Instance) int64 {
+	expiry := int64(i.GetData()["last_monitoring"].GetNumberValue())
+	product := i.GetBillingPlan().GetProducts()[i.GetProduct()]
+	if product.GetKind() == billing.Kind_POSTPAID {
+		expiry += product.GetPeriod()
+	}
+	return expiry
+}
+
+// billingOrder is the order instances reserve funds in: never billed ones first as their payment is urgent,
+// then the ones which expire earlier
+func billingOrder(a, b *ipb.Instance) int {
+	_, aBilled := a.GetData()["last_monitoring"]
+	_, bBilled := b.GetData()["last_monitoring"]
+	if aBilled != bBilled {
+		if !aBilled {
+			return -1
+		}
+		return 1
+	}
+	if c := cmp.Compare(instanceExpiry(a), instanceExpiry(b)); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.GetUuid(), b.GetUuid())
+}
+
+// creditLimit returns how far the balance may go below zero
+func creditLimit(i *ipb.Instance, sp *sppb.ServicesProvider) float64 {
+	return planOrSPValue(i, sp, "credit_limit").GetNumberValue()
+}
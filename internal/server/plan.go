@@ -0,0 +1,16 @@
+package server
+
+import (
+	"github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// planOrSPValue returns billing option set in billing plan meta, or in SP secrets if the plan doesn't set it
+func planOrSPValue(i *instances.Instance, sp *sppb.ServicesProvider, key string) *structpb.Value {
+	if val, ok := i.GetBillingPlan().GetMeta()[key]; ok {
+		return val
+	}
+	return sp.GetSecrets()[key]
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	epb "github.com/slntopp/nocloud-proto/events"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	stpb "github.com/slntopp/nocloud-proto/states"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// billingPreview collects everything billing handlers would publish
+type billingPreview struct {
+	mu sync.Mutex
+
+	records []*billing.Record
+	events  []*epb.Event
+	states  []*stpb.ObjectState
+	data    map[string]*structpb.Value
+}
+
+// previewDriver returns driver copy, which publishes nothing and collects the output into preview instead
+func (s *VirtualDriver) previewDriver(preview *billingPreview) *VirtualDriver {
+	driver := NewDetachedVirtualDriver(s.log, s.Type, s.clock)
+	driver.log = s.log.Named("Preview")
+	driver.rates = s.rates
+
+	driver.HandlePublishRecords = func(records []*billing.Record) {
+		preview.mu.Lock()
+		defer preview.mu.Unlock()
+		preview.records = append(preview.records, records...)
+	}
+	driver.HandlePublishEvent = func(event *epb.Event) {
+		preview.mu.Lock()
+		defer preview.mu.Unlock()
+		preview.events = append(preview.events, event)
+	}
+	driver.HandlePublishSPState = func(*stpb.ObjectState) (int, error) {
+		return 0, nil
+	}
+	driver.HandlePublishInstanceState = func(state *stpb.ObjectState) (int, error) {
+		preview.mu.Lock()
+		defer preview.mu.Unlock()
+		preview.states = append(preview.states, state)
+		return 0, nil
+	}
+	driver.HandlePublishInstanceData = func(data *ipb.ObjectData) (int, error) {
+		preview.mu.Lock()
+		defer preview.mu.Unlock()
+		preview.data = data.GetData()
+		return 0, nil
+	}
+	driver.HandleUpdateInstance = func(context.Context, *ipb.Instance) error {
+		return nil
+	}
+
+	return driver
+}
+
+// _handleBillingPreview runs billing routine for the instance copy the same way Monitoring does, without publishing anything
+func (s *VirtualDriver) _handleBillingPreview(inst *ipb.Instance, sp *sppb.ServicesProvider, params map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+	log := s.log.Named("BillingPreview").Named(inst.GetUuid())
+
+	addons, err := addonsFromParams(params)
+	if err != nil {
+		return &ipb.InvokeResponse{Result: false}, err
+	}
+
+	// Balance is considered sufficient unless given
+	balance := math.MaxFloat64
+	if val, ok := params["balance"]; ok {
+		balance = val.GetNumberValue()
+	}
+
+	i := proto.Clone(inst).(*ipb.Instance)
+	if i.GetData() == nil {
+		i.Data = make(map[string]*structpb.Value)
+	}
+	if i.GetConfig() == nil {
+		i.Config = make(map[string]*structpb.Value)
+	}
+
+	preview := &billingPreview{}
+	driver := s.previewDriver(preview)
+	// Billing may be previewed as of any given moment
+	if val, ok := params["at"]; ok {
+		driver.clock = utils.NewFakeClock(time.Unix(int64(val.GetNumberValue()), 0))
+	}
+	// Deleted, frozen and retained instances are handled the same way as in Monitoring
+	if !driver.billable(log, i, addons, sp) {
+		log.Debug("Instance is not billed")
+	} else if i.GetConfig()["auto_renew"].GetBoolValue() {
+		driver._handleInstanceBilling(i, newLedger(balance), addons, sp)
+	} else {
+		driver._handleNonRegularBilling(i, addons, sp)
+	}
+	driver.Wait()
+
+	log.Debug("Preview", zap.Any("records", preview.records), zap.Any("events", preview.events), zap.Any("states", preview.states))
+
+	records := make([]*structpb.Value, 0, len(preview.records))
+	for _, rec := range preview.records {
+		records = append(records, toStructValue(rec))
+	}
+	events := make([]*structpb.Value, 0, len(preview.events))
+	for _, event := range preview.events {
+		events = append(events, toStructValue(event))
+	}
+
+	meta := map[string]*structpb.Value{
+		"records": structpb.NewListValue(&structpb.ListValue{Values: records}),
+		"events":  structpb.NewListValue(&structpb.ListValue{Values: events}),
+	}
+	if len(preview.states) != 0 {
+		state := preview.states[len(preview.states)-1].GetState().GetState()
+		meta["state"] = structpb.NewStringValue(state.String())
+	}
+	if preview.data != nil {
+		if val, ok := preview.data["last_monitoring"]; ok {
+			meta["last_monitoring"] = val
+		}
+		if val, ok := preview.data["next_payment_date"]; ok {
+			meta["next_payment_date"] = val
+		}
+	}
+
+	return &ipb.InvokeResponse{Result: true, Meta: meta}, nil
+}
+
+// addonsFromParams decodes addons given in action params, as InvokeRequest doesn't carry them
+func addonsFromParams(params map[string]*structpb.Value) (map[string]*apb.Addon, error) {
+	addons := make(map[string]*apb.Addon)
+	for _, val := range params["addons"].GetListValue().GetValues() {
+		body, err := protojson.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		addon := &apb.Addon{}
+		if err = protojson.Unmarshal(body, addon); err != nil {
+			return nil, err
+		}
+		addons[addon.GetUuid()] = addon
+	}
+	return addons, nil
+}
+
+func toStructValue(msg proto.Message) *structpb.Value {
+	body, err := protojson.Marshal(msg)
+	if err != nil {
+		return structpb.NewNullValue()
+	}
+	val := &structpb.Value{}
+	if err = protojson.Unmarshal(body, val); err != nil {
+		return structpb.NewNullValue()
+	}
+	return val
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	epb "github.com/slntopp/nocloud-proto/events"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	stpb "github.com/slntopp/nocloud-proto/states"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// refundRecords returns negative records for the unused part of current prepaid product and addons periods,
+// last_monitoring of refunded items is moved back to now. Product is refunded at the price it was paid with discount,
+// addons are refunded only if their definitions are given
+func refundRecords(i *ipb.Instance, addons map[string]*apb.Addon, now int64) []*billing.Record {
+	product, ok := i.GetBillingPlan().GetProducts()[i.GetProduct()]
+	if !ok || product.GetPeriod() == 0 {
+		return nil
+	}
+
+	var records []*billing.Record
+	refund := func(key string, period int64, periodKind billing.PeriodKind, rec *billing.Record, factor float64) {
+		lmValue, ok := i.Data[key]
+		if !ok || period == 0 {
+			return
+		}
+		lm := int64(lmValue.GetNumberValue())
+		start := utils.PreviousPaymentDate(lm, period, periodKind, i)
+		unused := utils.Prorate(start, lm, now)
+		if unused <= 0 {
+			return
+		}
+		rec.Instance = i.GetUuid()
+		rec.Start, rec.End, rec.Exec = now, lm, now
+		rec.Priority = billing.Priority_URGENT
+		rec.Total = -unused * factor
+		rec.Meta = map[string]*structpb.Value{
+			"refund": structpb.NewBoolValue(true),
+		}
+		records = append(records, rec)
+		i.Data[key] = structpb.NewNumberValue(float64(now))
+	}
+
+	if product.GetKind() == billing.Kind_PREPAID {
+		lm := int64(i.Data["last_monitoring"].GetNumberValue())
+		refund("last_monitoring", product.GetPeriod(), product.GetPeriodKind(), &billing.Record{Product: i.GetProduct()}, paidFactor(i.Data, lm))
+	}
+	for _, addonId := range i.GetAddons() {
+		addon, ok := addons[addonId]
+		if !ok || addon.GetKind() != apb.Kind_PREPAID {
+			continue
+		}
+		period, periodKind := addonPeriod(addon, product)
+		refund(fmt.Sprintf("addon_%s_last_monitoring", addonId), period, periodKind, &billing.Record{Addon: addonId}, 1)
+	}
+
+	return records
+}
+
+// _handleRefund gives back money for the unused prepaid time and moves the instance to the terminal state
+func (s *VirtualDriver) _handleRefund(inst *ipb.Instance, sp *sppb.ServicesProvider, params map[string]*structpb.Value) (*ipb.InvokeResponse, error) {
+	log := s.log.Named("Refund").Named(inst.GetUuid())
+
+	if inst.GetState().GetState() == stpb.NoCloudState_DELETED {
+		return &ipb.InvokeResponse{Result: false}, errors.New("instance is already deleted")
+	}
+
+	addons, err := addonsFromParams(params)
+	if err != nil {
+		return &ipb.InvokeResponse{Result: false}, err
+	}
+	// Addons are refunded at their own prices, so the definitions of all the attached ones are required
+	for _, addonId := range inst.GetAddons() {
+		if _, ok := addons[addonId]; !ok {
+			return &ipb.InvokeResponse{Result: false}, fmt.Errorf("addon %s definition is not provided", addonId)
+		}
+	}
+	if inst.GetData() == nil {
+		inst.Data = make(map[string]*structpb.Value)
+	}
+
+	now := s.clock.Now().Unix()
+	records := refundRecords(inst, addons, now)
+	price, err := calculateRecordsPrice(records, addons, inst, s.currencyConverter(inst, sp))
+	if err != nil {
+		log.Error("Failed to calculate refund", zap.Error(err))
+		return &ipb.InvokeResponse{Result: false}, err
+	}
+	// Tax charged with the payment is given back as well
+	tax := instanceTax(inst, sp)
+	applyTax(tax, records)
+	amount := -tax.gross(price)
+	log.Debug("Refund", zap.Any("records", records), zap.Float64("amount", amount))
+
+	inst.Data["refunded_at"] = structpb.NewNumberValue(float64(now))
+	inst.Data["next_payment_date"] = structpb.NewNumberValue(float64(now))
+	inst.State = &stpb.State{State: stpb.NoCloudState_DELETED}
+
+	s.HandlePublishRecords(records)
+	s.HandlePublishInstanceState(&stpb.ObjectState{
+		Uuid:  inst.GetUuid(),
+		State: inst.GetState(),
+	})
+	eventData := map[string]*structpb.Value{
+		"amount": structpb.NewNumberValue(amount),
+	}
+	if tax != nil {
+		eventData["tax"] = structpb.NewNumberValue(tax.amount(-price))
+		for key, val := range tax.meta() {
+			eventData[key] = val
+		}
+	}
+	s.HandlePublishEvent(&epb.Event{
+		Uuid: inst.GetUuid(),
+		Key:  "instance_refunded",
+		Data: eventData,
+	})
+	utils.SendActualMonitoringData(inst.Data, inst.Data, inst.GetUuid(), s.HandlePublishInstanceData)
+
+	return &ipb.InvokeResponse{Result: true, Meta: map[string]*structpb.Value{
+		"amount": structpb.NewNumberValue(amount),
+	}}, nil
+}
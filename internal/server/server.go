@@ -22,8 +22,10 @@ import (
 	"github.com/slntopp/nocloud-proto/ansible"
 	eventpb "github.com/slntopp/nocloud-proto/events"
 	"github.com/slntopp/nocloud/pkg/nocloud/auth"
-	"time"
+	"slices"
+	"sync"
 
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
 	pb "github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
 	epb "github.com/slntopp/nocloud-proto/events"
 	ipb "github.com/slntopp/nocloud-proto/instances"
@@ -34,7 +36,9 @@ import (
 	i "github.com/slntopp/nocloud/pkg/instances"
 	"github.com/slntopp/nocloud/pkg/states"
 
+	"github.com/slntopp/nocloud-driver-virtual/internal/actions"
 	"github.com/slntopp/nocloud-driver-virtual/internal/pubsub"
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
 
 	"github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
@@ -56,8 +60,17 @@ type VirtualDriver struct {
 	HandlePublishInstanceState states.Pub
 	HandlePublishInstanceData  i.Pub
 
+	// Persists instance changes, such as config and addons, in nocloud
+	HandleUpdateInstance func(context.Context, *ipb.Instance) error
+
 	ansibleCtx    context.Context
 	ansibleClient ansible.AnsibleServiceClient
+
+	clock utils.Clock
+	rates utils.Rates
+
+	// Background routines started by the driver, see async
+	tasks *sync.WaitGroup
 }
 
 func NewVirtualDriver(log *zap.Logger, rbmq *amqp091.Connection, rdb *redis.Client, key []byte, _type string) *VirtualDriver {
@@ -70,9 +83,60 @@ func NewVirtualDriver(log *zap.Logger, rbmq *amqp091.Connection, rdb *redis.Clie
 		HandlePublishInstanceState: pubsub.SetupInstancesStatesPublisher(log, rbmq),
 		HandlePublishInstanceData:  pubsub.SetupInstancesDataPublisher(log, rbmq),
 		HandlePublishEvent:         pubsub.SetupEventsPublisher(log, rbmq),
+
+		HandleUpdateInstance: actions.UpdateInstance,
+
+		clock: utils.SystemClock{},
+		tasks: &sync.WaitGroup{},
+	}
+}
+
+// NewDetachedVirtualDriver creates driver which isn't connected to any broker, so every publisher and HandleUpdateInstance must be set by the caller
+func NewDetachedVirtualDriver(log *zap.Logger, _type string, clock utils.Clock) *VirtualDriver {
+	return &VirtualDriver{
+		log: log.Named("VirtualDriver").Named(_type), Type: _type,
+
+		clock: clock,
+		tasks: &sync.WaitGroup{},
 	}
 }
 
+// Wait blocks until all routines started in background by the driver are done
+func (s *VirtualDriver) Wait() {
+	s.tasks.Wait()
+}
+
+// SetCurrencyRates sets exchange rates used unless overridden by SP secrets
+func (s *VirtualDriver) SetCurrencyRates(rates utils.Rates) {
+	s.rates = rates
+}
+
+// SetClock replaces the time source used by billing and lifecycle routines
+func (s *VirtualDriver) SetClock(clock utils.Clock) {
+	s.clock = clock
+}
+
+// async runs f in background and tracks it, so one can wait for all publishing to finish
+func (s *VirtualDriver) async(f func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		f()
+	}()
+}
+
+func (s *VirtualDriver) publishInstanceStateAsync(state *stpb.ObjectState) {
+	s.async(func() { _, _ = s.HandlePublishInstanceState(state) })
+}
+
+func (s *VirtualDriver) publishInstanceDataAsync(data *ipb.ObjectData) {
+	s.async(func() { _, _ = s.HandlePublishInstanceData(data) })
+}
+
+func (s *VirtualDriver) publishEventAsync(event *epb.Event) {
+	s.async(func() { s.HandlePublishEvent(event) })
+}
+
 func (s *VirtualDriver) GetType(ctx context.Context, req *pb.GetTypeRequest) (*pb.GetTypeResponse, error) {
 	return &pb.GetTypeResponse{Type: s.Type}, nil
 }
@@ -115,11 +179,12 @@ func (s *VirtualDriver) GetExpiration(_ context.Context, request *pb.GetExpirati
 		}
 
 		for _, a := range inst.GetAddons() {
-			if lm, ok := data[fmt.Sprintf("addon_%s_last_monitoring", a)]; ok && product.GetPeriod() > 0 {
+			period, _ := utils.StoredAddonPeriod(data, a, product)
+			if lm, ok := data[fmt.Sprintf("addon_%s_last_monitoring", a)]; ok && period > 0 {
 				records = append(records, &pb.ExpirationRecord{
 					Expires: int64(lm.GetNumberValue()),
 					Addon:   a,
-					Period:  product.GetPeriod(),
+					Period:  period,
 				})
 			}
 		}
@@ -158,7 +223,7 @@ func (s *VirtualDriver) Up(ctx context.Context, input *pb.UpRequest) (*pb.UpResp
 				inst.State = &stpb.State{
 					State: stpb.NoCloudState_RUNNING,
 				}
-				go s.HandlePublishInstanceState(&stpb.ObjectState{
+				s.publishInstanceStateAsync(&stpb.ObjectState{
 					Uuid:  inst.GetUuid(),
 					State: inst.GetState(),
 				})
@@ -184,6 +249,30 @@ func (s *VirtualDriver) Down(ctx context.Context, input *pb.DownRequest) (*pb.Do
 	return &pb.DownResponse{Group: igroup}, nil
 }
 
+// billable settles deleted instances and deletes ones suspended for too long. Returns false if the instance
+// is deleted or frozen, so it isn't billed at this tick
+func (s *VirtualDriver) billable(log *zap.Logger, i *ipb.Instance, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) bool {
+	if i.GetStatus() == sttspb.NoCloudStatus_DEL {
+		if i.GetState().GetState() != stpb.NoCloudState_DELETED {
+			s.handleFinalSettlement(log, i, addons, sp)
+			i.State = &stpb.State{State: stpb.NoCloudState_DELETED}
+			s.HandlePublishInstanceState(&stpb.ObjectState{
+				Uuid:  i.GetUuid(),
+				State: i.GetState(),
+			})
+		}
+		return false
+	}
+
+	// Frozen instances are neither billed nor suspended until unfrozen
+	if i.GetData()["freeze"].GetBoolValue() {
+		log.Debug("Instance is frozen", zap.String("uuid", i.GetUuid()))
+		return false
+	}
+
+	return !s.handleRetention(log, i, sp)
+}
+
 func (s *VirtualDriver) Monitoring(ctx context.Context, req *pb.MonitoringRequest) (*pb.MonitoringResponse, error) {
 	log := s.log.Named("Monitoring")
 	sp := req.GetServicesProvider()
@@ -193,8 +282,11 @@ func (s *VirtualDriver) Monitoring(ctx context.Context, req *pb.MonitoringReques
 		req.Balance = make(map[string]float64)
 	}
 
+	var wg sync.WaitGroup
+	ledgers := make(map[string]*ledger)
 	for _, group := range req.GetGroups() {
 		log.Debug("Monitoring Group", zap.String("uuid", group.GetUuid()), zap.String("title", group.GetTitle()), zap.Int("instances", len(group.GetInstances())))
+		var billable []*ipb.Instance
 		for _, i := range group.GetInstances() {
 			log.Debug("Monitoring Instance", zap.String("uuid", i.GetUuid()), zap.String("title", i.GetTitle()), zap.Any("body", i))
 
@@ -234,7 +326,7 @@ func (s *VirtualDriver) Monitoring(ctx context.Context, req *pb.MonitoringReques
 							},
 						})
 					}
-					i.Data["start"] = structpb.NewNumberValue(float64(time.Now().Unix()))
+					i.Data["start"] = structpb.NewNumberValue(float64(s.clock.Now().Unix()))
 					s.HandlePublishInstanceData(&ipb.ObjectData{
 						Uuid: i.GetUuid(),
 						Data: i.GetData(),
@@ -245,64 +337,65 @@ func (s *VirtualDriver) Monitoring(ctx context.Context, req *pb.MonitoringReques
 					}
 
 					if !i.GetData()["pending_notification"].GetBoolValue() {
-						go s.HandlePublishEvent(&epb.Event{
+						s.publishEventAsync(&epb.Event{
 							Uuid: i.GetUuid(),
 							Key:  "pending_notification",
 						})
 						i.Data["pending_notification"] = structpb.NewBoolValue(true)
-						go s.HandlePublishInstanceData(&ipb.ObjectData{
+						s.publishInstanceDataAsync(&ipb.ObjectData{
 							Uuid: i.GetUuid(),
 							Data: i.GetData(),
 						})
 					}
 				}
 
-				go s.HandlePublishInstanceState(&stpb.ObjectState{
+				s.publishInstanceStateAsync(&stpb.ObjectState{
 					Uuid:  i.GetUuid(),
 					State: i.GetState(),
 				})
 			}
 
-			if i.GetStatus() == sttspb.NoCloudStatus_DEL {
-				if i.GetState().GetState() != stpb.NoCloudState_DELETED {
-					i.State.State = stpb.NoCloudState_DELETED
-					s.HandlePublishInstanceState(&stpb.ObjectState{
-						Uuid:  i.GetUuid(),
-						State: i.GetState(),
-					})
-				}
+			if !s.billable(log, i, req.GetAddons(), sp) {
 				continue
 			}
 
 			_, ok := i.GetData()["creation"]
 
 			if !ok {
-				i.Data["creation"] = structpb.NewNumberValue(float64(time.Now().Unix()))
+				i.Data["creation"] = structpb.NewNumberValue(float64(s.clock.Now().Unix()))
 				s.HandlePublishInstanceData(&ipb.ObjectData{
 					Uuid: i.GetUuid(), Data: i.GetData(),
 				})
 			}
 
-			autoRenew := false
+			log.Debug("Cfg", zap.String("uuid", i.GetUuid()), zap.Any("cfg", instConfig))
+			billable = append(billable, i)
+		}
 
-			if instConfig != nil {
-				autoRenewVal, ok := instConfig["auto_renew"]
-				if ok {
-					autoRenew = autoRenewVal.GetBoolValue()
+		// Instances of the group share the balance, so they are billed one by one in the deterministic order,
+		// while groups are billed concurrently
+		slices.SortFunc(billable, billingOrder)
+		balance, ok := ledgers[group.GetUuid()]
+		if !ok {
+			balance = newLedger(req.GetBalance()[group.GetUuid()])
+			ledgers[group.GetUuid()] = balance
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, i := range billable {
+				if i.GetConfig()["auto_renew"].GetBoolValue() {
+					s._handleInstanceBilling(i, balance, req.Addons, sp)
+				} else {
+					s._handleNonRegularBilling(i, req.Addons, sp)
 				}
-
 			}
+		}()
+	}
+	wg.Wait()
 
-			log.Debug("Cfg", zap.String("uuid", i.GetUuid()), zap.Any("cfg", instConfig))
-
-			balance := req.GetBalance()[group.GetUuid()]
-			if autoRenew {
-				go s._handleInstanceBilling(i, &balance, req.Addons, sp)
-			} else {
-				go s._handleNonRegularBilling(i, req.Addons, sp)
-			}
-			req.Balance[group.GetUuid()] = balance
-		}
+	for group, balance := range ledgers {
+		req.Balance[group] = balance.Balance()
 	}
 
 	// Placeholder
@@ -311,7 +404,7 @@ func (s *VirtualDriver) Monitoring(ctx context.Context, req *pb.MonitoringReques
 		State: &stpb.State{
 			State: stpb.NoCloudState_RUNNING,
 			Meta: map[string]*structpb.Value{
-				"ts": structpb.NewNumberValue(float64(time.Now().Unix())),
+				"ts": structpb.NewNumberValue(float64(s.clock.Now().Unix())),
 			},
 		},
 	})
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	"github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// refundOnDelete tells if unused prepaid time is refunded when instance is deleted
+func refundOnDelete(i *instances.Instance, sp *sppb.ServicesProvider) bool {
+	return planOrSPValue(i, sp, "refund_on_delete").GetBoolValue()
+}
+
+// settlementRecords returns records for the postpaid time used since the last payment and metered usage not billed yet
+func settlementRecords(log *zap.Logger, i *instances.Instance, addons map[string]*apb.Addon, now int64) []*billing.Record {
+	var records []*billing.Record
+	used := func(lmValue *structpb.Value, period int64, periodKind billing.PeriodKind, rec *billing.Record, amount float64) {
+		if lmValue == nil || period == 0 {
+			return
+		}
+		lm := int64(lmValue.GetNumberValue())
+		end := utils.NextPaymentDate(lm, period, periodKind, i)
+		fraction := 1 - utils.Prorate(lm, end, now)
+		if lm >= now || fraction <= 0 {
+			return
+		}
+		rec.Instance = i.GetUuid()
+		rec.Start, rec.End, rec.Exec = lm, now, now
+		rec.Priority = billing.Priority_URGENT
+		rec.Total = fraction * amount
+		records = append(records, rec)
+	}
+
+	product, ok := i.GetBillingPlan().GetProducts()[i.GetProduct()]
+	if ok && product.GetKind() == billing.Kind_POSTPAID {
+		used(i.Data["last_monitoring"], product.GetPeriod(), product.GetPeriodKind(), &billing.Record{Product: i.GetProduct()}, 1)
+	}
+	for _, addonId := range i.GetAddons() {
+		if addon, ok := addons[addonId]; !ok || addon.GetKind() != apb.Kind_POSTPAID {
+			continue
+		}
+		period, periodKind := utils.StoredAddonPeriod(i.Data, addonId, product)
+		used(i.Data[fmt.Sprintf("addon_%s_last_monitoring", addonId)], period, periodKind, &billing.Record{Addon: addonId}, 1)
+	}
+
+	for _, res := range i.GetBillingPlan().GetResources() {
+		if utils.ResourceMetered(res) {
+			records = append(records, handleUsageBilling(log, i, res, now)...)
+			continue
+		}
+		if res.GetKind() != billing.Kind_POSTPAID {
+			continue
+		}
+		amount := i.GetResources()[res.GetKey()].GetNumberValue()
+		used(i.Data[fmt.Sprintf("%s_last_monitoring", res.GetKey())], res.GetPeriod(), res.GetPeriodKind(), &billing.Record{Resource: res.GetKey()}, amount)
+	}
+
+	return records
+}
+
+// clearBillingData removes billing state from instance data
+func clearBillingData(data map[string]*structpb.Value) {
+	for key := range data {
+		switch {
+		case key == "last_monitoring", key == "next_payment_date", key == "notification_period",
+			strings.HasPrefix(key, "addon_"), strings.HasPrefix(key, "grace_period_"), strings.HasPrefix(key, "spending_"),
+			strings.HasSuffix(key, "_last_monitoring"), strings.HasSuffix(key, "_usage"), strings.HasSuffix(key, "_usage_start"), strings.HasSuffix(key, "_usage_end"):
+			delete(data, key)
+		}
+	}
+}
+
+// handleFinalSettlement bills what deleted instance owes, refunds unused prepaid time if refund policy is enabled
+// and clears billing data. It's called once, when the instance is moved to the DELETED state
+func (s *VirtualDriver) handleFinalSettlement(log *zap.Logger, i *instances.Instance, addons map[string]*apb.Addon, sp *sppb.ServicesProvider) {
+	log = log.Named("Settlement").Named(i.GetUuid())
+	if i.GetBillingPlan() == nil {
+		return
+	}
+
+	if i.Data == nil {
+		i.Data = make(map[string]*structpb.Value)
+	}
+
+	// Records end at the deletion time stored on the first attempt, so their idempotency keys don't change if settlement is repeated
+	deletedAt, ok := i.Data["deleted_at"]
+	if !ok {
+		deletedAt = structpb.NewNumberValue(float64(s.clock.Now().Unix()))
+		i.Data["deleted_at"] = deletedAt
+	}
+	now := int64(deletedAt.GetNumberValue())
+
+	records := settlementRecords(log, i, addons, now)
+	if refundOnDelete(i, sp) {
+		records = append(records, refundRecords(i, addons, now)...)
+	}
+	if len(records) != 0 {
+		applyTax(instanceTax(i, sp), records)
+		log.Debug("Final records", zap.Any("records", records))
+		s.HandlePublishRecords(records)
+	}
+
+	clearBillingData(i.Data)
+	s.publishInstanceDataAsync(&instances.ObjectData{
+		Uuid: i.GetUuid(),
+		Data: i.GetData(),
+	})
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud-proto/instances"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// skippedPayments returns entries of config skip_next_payment which weren't paid yet.
+// Entry may be the product, an addon uuid or a resource key, its first payment is skipped
+func skippedPayments(i *instances.Instance) map[string]bool {
+	skip := make(map[string]bool)
+	for _, val := range i.GetConfig()["skip_next_payment"].GetListValue().GetValues() {
+		item := val.GetStringValue()
+		var key string
+		switch {
+		case item == i.GetProduct():
+			key = "last_monitoring"
+		case slices.Contains(i.GetAddons(), item):
+			key = fmt.Sprintf("addon_%s_last_monitoring", item)
+		case slices.ContainsFunc(i.GetBillingPlan().GetResources(), func(res *billing.ResourceConf) bool { return res.GetKey() == item }):
+			key = fmt.Sprintf("%s_last_monitoring", item)
+		default:
+			continue
+		}
+		if _, ok := i.GetData()[key]; !ok {
+			skip[item] = true
+		}
+	}
+	return skip
+}
+
+// skipPayments drops records of skipped items, returns records left and items which payment was skipped
+func skipPayments(records []*billing.Record, skip map[string]bool) ([]*billing.Record, []string) {
+	if len(skip) == 0 {
+		return records, nil
+	}
+
+	var skipped []string
+	records = slices.DeleteFunc(records, func(rec *billing.Record) bool {
+		// Trial isn't a payment
+		if rec.GetMeta()["trial"].GetBoolValue() {
+			return false
+		}
+		for _, item := range []string{rec.GetProduct(), rec.GetAddon(), rec.GetResource()} {
+			if item != "" && skip[item] {
+				if !slices.Contains(skipped, item) {
+					skipped = append(skipped, item)
+				}
+				return true
+			}
+		}
+		return false
+	})
+	return records, skipped
+}
+
+// consumeSkippedPayments removes items which payment was skipped from config, so they're skipped only once
+func (s *VirtualDriver) consumeSkippedPayments(log *zap.Logger, i *instances.Instance, skipped []string) {
+	if len(skipped) == 0 {
+		return
+	}
+
+	values := slices.DeleteFunc(i.GetConfig()["skip_next_payment"].GetListValue().GetValues(), func(val *structpb.Value) bool {
+		return slices.Contains(skipped, val.GetStringValue())
+	})
+	i.Config["skip_next_payment"] = structpb.NewListValue(&structpb.ListValue{Values: values})
+
+	log.Debug("Skipped payments", zap.Strings("items", skipped))
+	if err := s.HandleUpdateInstance(context.Background(), i); err != nil {
+		log.Error("Failed to update instance config", zap.Error(err))
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	epb "github.com/slntopp/nocloud-proto/events"
+	"github.com/slntopp/nocloud-proto/instances"
+	stpb "github.com/slntopp/nocloud-proto/states"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// testDriver returns detached driver with the given clock, which collects published records
+func testDriver(clock utils.Clock) (*VirtualDriver, func() []*billing.Record) {
+	var (
+		mu      sync.Mutex
+		records []*billing.Record
+	)
+	s := NewDetachedVirtualDriver(zap.NewNop(), "virtual", clock)
+	s.HandlePublishRecords = func(recs []*billing.Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, recs...)
+	}
+	s.HandlePublishEvent = func(*epb.Event) {}
+	s.HandlePublishSPState = func(*stpb.ObjectState) (int, error) { return 0, nil }
+	s.HandlePublishInstanceState = func(*stpb.ObjectState) (int, error) { return 0, nil }
+	s.HandlePublishInstanceData = func(*instances.ObjectData) (int, error) { return 0, nil }
+	s.HandleUpdateInstance = func(context.Context, *instances.Instance) error { return nil }
+	return s, func() []*billing.Record {
+		s.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return records
+	}
+}
+
+func TestSkipResourcePaymentNonRegular(t *testing.T) {
+	now := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	product := "month"
+	inst := &instances.Instance{
+		Uuid:    "inst",
+		Product: &product,
+		State:   &stpb.State{State: stpb.NoCloudState_RUNNING},
+		BillingPlan: &billing.Plan{
+			Kind: billing.PlanKind_STATIC,
+			Products: map[string]*billing.Product{
+				product: {Kind: billing.Kind_PREPAID, Price: 10, Period: 30 * 86400},
+			},
+			Resources: []*billing.ResourceConf{
+				{Key: "ip", Kind: billing.Kind_PREPAID, Price: 2, Period: 30 * 86400},
+			},
+		},
+		Resources: map[string]*structpb.Value{"ip": structpb.NewNumberValue(1)},
+		Config: map[string]*structpb.Value{
+			"skip_next_payment": structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{structpb.NewStringValue("ip")}}),
+		},
+		Data: map[string]*structpb.Value{
+			"last_monitoring": structpb.NewNumberValue(float64(now.AddDate(0, 0, 20).Unix())),
+		},
+	}
+
+	s, published := testDriver(utils.NewFakeClock(now))
+	s._handleNonRegularBilling(inst, nil, nil)
+
+	for _, rec := range published() {
+		if rec.GetResource() == "ip" {
+			t.Errorf("skipped resource is charged: %v", rec)
+		}
+	}
+	if _, ok := inst.Data["ip_last_monitoring"]; !ok {
+		t.Error("resource period didn't start")
+	}
+	if skip := inst.Config["skip_next_payment"].GetListValue().GetValues(); len(skip) != 0 {
+		t.Errorf("skip_next_payment wasn't consumed: %v", skip)
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"math"
+	"slices"
+
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	apb "github.com/slntopp/nocloud-proto/billing/addons"
+	epb "github.com/slntopp/nocloud-proto/events"
+	"github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// spendingPeriodStart returns start of the current product period
+func spendingPeriodStart(i *instances.Instance) int64 {
+	lm := int64(i.Data["last_monitoring"].GetNumberValue())
+	product := i.GetBillingPlan().GetProducts()[i.GetProduct()]
+	if product.GetKind() == billing.Kind_PREPAID && product.GetPeriod() > 0 {
+		return utils.PreviousPaymentDate(lm, product.GetPeriod(), product.GetPeriodKind(), i)
+	}
+	return lm
+}
+
+// spendingRecords returns records counted against the spending limit: postpaid product and resources ones
+// which belong to the current period
+func spendingRecords(i *instances.Instance, records []*billing.Record, start int64) []*billing.Record {
+	product := i.GetBillingPlan().GetProducts()[i.GetProduct()]
+	var result []*billing.Record
+	for _, rec := range records {
+		if rec.GetEnd() <= start {
+			continue
+		}
+		if rec.GetResource() != "" || (rec.GetProduct() != "" && product.GetKind() == billing.Kind_POSTPAID) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// dropCappedRecords removes records counted against the spending limit from the period it was reached in,
+// so nothing over the limit is charged. The period may be over already, then only its records are removed
+func dropCappedRecords(log *zap.Logger, i *instances.Instance, records []*billing.Record) []*billing.Record {
+	if i.GetConfig()["spending_limit"].GetNumberValue() <= 0 || !i.Data["spending_limit_reached"].GetBoolValue() {
+		return records
+	}
+	start := int64(i.Data["spending_period"].GetNumberValue())
+	end := spendingPeriodStart(i)
+	if end == start {
+		end = math.MaxInt64
+	}
+
+	capped := spendingRecords(i, records, start)
+	capped = slices.DeleteFunc(capped, func(rec *billing.Record) bool {
+		return rec.GetStart() >= end
+	})
+	if len(capped) == 0 {
+		return records
+	}
+	log.Debug("Spending limit is reached, dropping records", zap.Int("records", len(capped)))
+	return slices.DeleteFunc(records, func(rec *billing.Record) bool {
+		return slices.Contains(capped, rec)
+	})
+}
+
+// handleSpendingLimit accumulates instance spending in the current period against config spending_limit.
+// Spending is reset when the product period changes. Returns true if the limit is reached
+func (s *VirtualDriver) handleSpendingLimit(log *zap.Logger, i *instances.Instance, sp *sppb.ServicesProvider, addons map[string]*apb.Addon, records []*billing.Record) bool {
+	limit := i.GetConfig()["spending_limit"].GetNumberValue()
+	if limit <= 0 {
+		delete(i.Data, "spending_limit_reached")
+		return false
+	}
+
+	start := spendingPeriodStart(i)
+	if int64(i.Data["spending_period"].GetNumberValue()) != start {
+		i.Data["spending_period"] = structpb.NewNumberValue(float64(start))
+		i.Data["spending_amount"] = structpb.NewNumberValue(0)
+		delete(i.Data, "spending_limit_reached")
+	}
+
+	price, err := calculateRecordsPrice(spendingRecords(i, records, start), addons, i, s.currencyConverter(i, sp))
+	if err != nil {
+		log.Error("Failed to calculate spending", zap.Error(err))
+		return i.Data["spending_limit_reached"].GetBoolValue()
+	}
+	amount := i.Data["spending_amount"].GetNumberValue() + price
+	i.Data["spending_amount"] = structpb.NewNumberValue(amount)
+
+	if amount < limit || i.Data["spending_limit_reached"].GetBoolValue() {
+		return i.Data["spending_limit_reached"].GetBoolValue()
+	}
+
+	log.Info("Spending limit reached", zap.Float64("amount", amount), zap.Float64("limit", limit))
+	i.Data["spending_limit_reached"] = structpb.NewBoolValue(true)
+	s.publishEventAsync(&epb.Event{
+		Uuid: i.GetUuid(),
+		Key:  "spending_limit_reached",
+		Data: map[string]*structpb.Value{
+			"amount": structpb.NewNumberValue(amount),
+			"limit":  structpb.NewNumberValue(limit),
+		},
+	})
+	return true
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	epb "github.com/slntopp/nocloud-proto/events"
+	"github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+	statespb "github.com/slntopp/nocloud-proto/states"
+	"github.com/slntopp/nocloud/pkg/nocloud/suspend_rules"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Interval between grace_period_reminder events
+const gracePeriodReminder = 86400
+
+// Days before deletion of suspended instance to send instance_deletion_warning events
+var deletionWarnings = []int64{7, 3, 1}
+
+// gracePeriod returns time in seconds the instance keeps running after it wasn't paid
+func gracePeriod(i *instances.Instance, sp *sppb.ServicesProvider) int64 {
+	return int64(planOrSPValue(i, sp, "grace_period").GetNumberValue())
+}
+
+// handleUnpaid suspends the instance once its grace period is over, data is the instance data to be published afterwards
+func (s *VirtualDriver) handleUnpaid(log *zap.Logger, i *instances.Instance, sp *sppb.ServicesProvider, data map[string]*structpb.Value, now int64) {
+	if i.GetState().GetState() == statespb.NoCloudState_SUSPENDED {
+		return
+	}
+
+	if grace := gracePeriod(i, sp); grace > 0 {
+		startValue, ok := data["grace_period_start"]
+		if !ok {
+			log.Debug("Starting grace period", zap.Int64("end", now+grace))
+			data["grace_period_start"] = structpb.NewNumberValue(float64(now))
+			data["grace_period_reminder"] = structpb.NewNumberValue(float64(now))
+			s.publishGracePeriodEvent(i, "grace_period_started", now+grace)
+			return
+		}
+
+		end := int64(startValue.GetNumberValue()) + grace
+		if now < end {
+			if now-int64(data["grace_period_reminder"].GetNumberValue()) >= gracePeriodReminder {
+				data["grace_period_reminder"] = structpb.NewNumberValue(float64(now))
+				s.publishGracePeriodEvent(i, "grace_period_reminder", end)
+			}
+			return
+		}
+		log.Debug("Grace period is over", zap.Int64("end", end))
+	}
+
+	if s.suspendInstance(i, sp, data, now) {
+		clearGracePeriod(data)
+	}
+}
+
+// suspendInstance suspends the instance if SP suspend rules allow it at the moment
+func (s *VirtualDriver) suspendInstance(i *instances.Instance, sp *sppb.ServicesProvider, data map[string]*structpb.Value, now int64) bool {
+	if !suspend_rules.SuspendAllowed(sp.GetSuspendRules(), s.clock.Now().UTC()) {
+		return false
+	}
+
+	s.publishInstanceStateAsync(&statespb.ObjectState{
+		Uuid: i.GetUuid(),
+		State: &statespb.State{
+			State: statespb.NoCloudState_SUSPENDED,
+		},
+	})
+	s.publishEventAsync(&epb.Event{
+		Uuid: i.GetUuid(),
+		Key:  "instance_suspended",
+		Data: map[string]*structpb.Value{},
+	})
+	data["suspended_at"] = structpb.NewNumberValue(float64(now))
+	return true
+}
+
+// clearGracePeriod resets grace period once the instance is paid or suspended
+func clearGracePeriod(data map[string]*structpb.Value) {
+	delete(data, "grace_period_start")
+	delete(data, "grace_period_reminder")
+}
+
+func (s *VirtualDriver) publishGracePeriodEvent(i *instances.Instance, key string, end int64) {
+	year, month, day := time.Unix(end, 0).Date()
+	s.publishEventAsync(&epb.Event{
+		Uuid: i.GetUuid(),
+		Key:  key,
+		Data: map[string]*structpb.Value{
+			"date":     structpb.NewStringValue(fmt.Sprintf("%d/%d/%d", day, month, year)),
+			"deadline": structpb.NewNumberValue(float64(end)),
+		},
+	})
+}
+
+// retentionDays returns how many days the instance may stay suspended before deletion
+func retentionDays(i *instances.Instance, sp *sppb.ServicesProvider) int64 {
+	return int64(planOrSPValue(i, sp, "retention_days").GetNumberValue())
+}
+
+// handleRetention tracks how long the instance is suspended and deletes it once retention period is over.
+// Returns true if instance is deleted. Instances suspended manually are never deleted
+func (s *VirtualDriver) handleRetention(log *zap.Logger, i *instances.Instance, sp *sppb.ServicesProvider) bool {
+	if i.GetState().GetState() == statespb.NoCloudState_DELETED {
+		return true
+	}
+	if i.GetState().GetState() != statespb.NoCloudState_SUSPENDED {
+		delete(i.Data, "suspended_at")
+		delete(i.Data, "deletion_warning")
+		return false
+	}
+
+	now := s.clock.Now().Unix()
+	suspendedAt, ok := i.Data["suspended_at"]
+	if !ok {
+		suspendedAt = structpb.NewNumberValue(float64(now))
+		i.Data["suspended_at"] = suspendedAt
+	}
+
+	days := retentionDays(i, sp)
+	if days <= 0 || i.Data["suspended_manually"].GetBoolValue() {
+		return false
+	}
+	deletion := int64(suspendedAt.GetNumberValue()) + days*86400
+
+	if now < deletion {
+		// Closest warning to the deletion date, which wasn't sent yet
+		warning := int64(0)
+		for _, days := range deletionWarnings {
+			if deletion-now <= days*86400 {
+				warning = days
+			}
+		}
+		sent, sentOk := i.Data["deletion_warning"]
+		if warning > 0 && (!sentOk || int64(sent.GetNumberValue()) > warning) {
+			i.Data["deletion_warning"] = structpb.NewNumberValue(float64(warning))
+			year, month, day := time.Unix(deletion, 0).Date()
+			s.publishEventAsync(&epb.Event{
+				Uuid: i.GetUuid(),
+				Key:  "instance_deletion_warning",
+				Data: map[string]*structpb.Value{
+					"days": structpb.NewNumberValue(float64(warning)),
+					"date": structpb.NewStringValue(fmt.Sprintf("%d/%d/%d", day, month, year)),
+				},
+			})
+		}
+		return false
+	}
+
+	log.Info("Retention period is over, deleting instance", zap.String("uuid", i.GetUuid()), zap.Int64("suspended_at", int64(suspendedAt.GetNumberValue())))
+	i.State = &statespb.State{State: statespb.NoCloudState_DELETED}
+	s.publishInstanceStateAsync(&statespb.ObjectState{
+		Uuid:  i.GetUuid(),
+		State: i.GetState(),
+	})
+	s.publishEventAsync(&epb.Event{
+		Uuid: i.GetUuid(),
+		Key:  "instance_deleted",
+		Data: map[string]*structpb.Value{
+			"reason": structpb.NewStringValue("retention"),
+		},
+	})
+	s.publishInstanceDataAsync(&instances.ObjectData{
+		Uuid: i.GetUuid(),
+		Data: i.GetData(),
+	})
+	return true
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud-proto/instances"
+	sppb "github.com/slntopp/nocloud-proto/services_providers"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Tax is read from SP secrets taxes, region is taken from instance config tax_region, e.g.
+// {"default": {"rate": 20}, "regions": {"US": {"rate": 7.5, "inclusive": false}, "DE": {"reverse_charge": true}}}
+// Rate is given in percents
+type Tax struct {
+	Region        string
+	Rate          float64
+	Inclusive     bool
+	ReverseCharge bool
+}
+
+// instanceTax returns tax rule for the instance account region, falling back to SP default one
+func instanceTax(i *instances.Instance, sp *sppb.ServicesProvider) *Tax {
+	taxes := sp.GetSecrets()["taxes"].GetStructValue().GetFields()
+	if taxes == nil {
+		return nil
+	}
+
+	region := i.GetConfig()["tax_region"].GetStringValue()
+	rule, ok := taxes["regions"].GetStructValue().GetFields()[region]
+	if !ok {
+		region = ""
+		rule, ok = taxes["default"]
+	}
+	if !ok {
+		return nil
+	}
+
+	fields := rule.GetStructValue().GetFields()
+	return &Tax{
+		Region:        region,
+		Rate:          fields["rate"].GetNumberValue(),
+		Inclusive:     fields["inclusive"].GetBoolValue(),
+		ReverseCharge: fields["reverse_charge"].GetBoolValue(),
+	}
+}
+
+// amount returns tax included into or to be added to the price
+func (t *Tax) amount(price float64) float64 {
+	if t == nil || t.ReverseCharge || t.Rate <= 0 {
+		return 0
+	}
+	if t.Inclusive {
+		return price - price/(1+t.Rate/100)
+	}
+	return price * t.Rate / 100
+}
+
+// gross returns price the account is charged
+func (t *Tax) gross(price float64) float64 {
+	if t == nil || t.Inclusive {
+		return price
+	}
+	return price + t.amount(price)
+}
+
+func (t *Tax) meta() map[string]*structpb.Value {
+	return map[string]*structpb.Value{
+		"tax_region":         structpb.NewStringValue(t.Region),
+		"tax_rate":           structpb.NewNumberValue(t.Rate),
+		"tax_inclusive":      structpb.NewBoolValue(t.Inclusive),
+		"tax_reverse_charge": structpb.NewBoolValue(t.ReverseCharge),
+	}
+}
+
+// applyTax attaches tax rule to records meta
+func applyTax(tax *Tax, records []*billing.Record) {
+	if tax == nil {
+		return
+	}
+	for _, rec := range records {
+		if rec.Meta == nil {
+			rec.Meta = make(map[string]*structpb.Value)
+		}
+		for key, val := range tax.meta() {
+			rec.Meta[key] = val
+		}
+	}
+}
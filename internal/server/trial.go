@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	epb "github.com/slntopp/nocloud-proto/events"
+	"github.com/slntopp/nocloud-proto/instances"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Default time before trial end to send trial_ending event
+const trialEndingNotice = 86400
+
+// trialPeriod returns trial duration in seconds, product meta takes precedence over the billing plan meta
+func trialPeriod(i *instances.Instance, product *billing.Product) int64 {
+	if val, ok := product.GetMeta()["trial_period"]; ok {
+		return int64(val.GetNumberValue())
+	}
+	return int64(i.GetBillingPlan().GetMeta()["trial_period"].GetNumberValue())
+}
+
+// handleTrial starts the trial if instance is eligible for one. Returns the zero cost trial record and the trial end
+func (s *VirtualDriver) handleTrial(log *zap.Logger, i *instances.Instance, product *billing.Product, now int64) ([]*billing.Record, int64, bool) {
+	trial := trialPeriod(i, product)
+	if trial <= 0 || product.GetPeriod() == 0 {
+		return nil, 0, false
+	}
+	// Trial is given only once
+	if _, ok := i.Data["trial_end"]; ok {
+		return nil, 0, false
+	}
+
+	end := now + trial
+	log.Debug("Starting trial", zap.Int64("end", end))
+	i.Data["trial_end"] = structpb.NewNumberValue(float64(end))
+	i.Data["last_monitoring"] = structpb.NewNumberValue(float64(end))
+
+	year, month, day := time.Unix(end, 0).Date()
+	s.publishEventAsync(&epb.Event{
+		Uuid: i.GetUuid(),
+		Key:  "trial_started",
+		Data: map[string]*structpb.Value{
+			"product": structpb.NewStringValue(i.GetProduct()),
+			"date":    structpb.NewStringValue(fmt.Sprintf("%d/%d/%d", day, month, year)),
+		},
+	})
+
+	return []*billing.Record{{
+		Product:  i.GetProduct(),
+		Instance: i.GetUuid(),
+		Start:    now, End: end, Exec: now,
+		Priority: billing.Priority_URGENT,
+		Total:    0,
+		Meta: map[string]*structpb.Value{
+			"trial": structpb.NewBoolValue(true),
+		},
+	}}, end, true
+}
+
+// handleTrialEnding notifies once when the trial is about to end
+func (s *VirtualDriver) handleTrialEnding(i *instances.Instance, now int64) {
+	endValue, ok := i.Data["trial_end"]
+	if !ok || i.Data["trial_ending_notified"].GetBoolValue() {
+		return
+	}
+	end := int64(endValue.GetNumberValue())
+
+	notice := int64(trialEndingNotice)
+	if val, ok := i.GetBillingPlan().GetMeta()["trial_ending_notice"]; ok {
+		notice = int64(val.GetNumberValue())
+	}
+	if now >= end || end-now > notice {
+		return
+	}
+
+	i.Data["trial_ending_notified"] = structpb.NewBoolValue(true)
+	year, month, day := time.Unix(end, 0).Date()
+	s.publishEventAsync(&epb.Event{
+		Uuid: i.GetUuid(),
+		Key:  "trial_ending",
+		Data: map[string]*structpb.Value{
+			"product": structpb.NewStringValue(i.GetProduct()),
+			"date":    structpb.NewStringValue(fmt.Sprintf("%d/%d/%d", day, month, year)),
+		},
+	})
+}
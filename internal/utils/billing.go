@@ -1,7 +1,14 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+
+	"github.com/slntopp/nocloud-proto/billing"
 	"github.com/slntopp/nocloud-proto/instances"
+	"github.com/slntopp/nocloud-proto/states"
 	i "github.com/slntopp/nocloud/pkg/instances"
 	"google.golang.org/protobuf/types/known/structpb"
 )
@@ -18,3 +25,48 @@ func SendActualMonitoringData(copiedData map[string]*structpb.Value, actualData
 		Data: copiedData,
 	})
 }
+
+// RecordIdempotencyKey returns the key which is the same for records of the same instance item and period,
+// so consumers may dedupe records published more than once
+func RecordIdempotencyKey(rec *billing.Record) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%s/%d/%d",
+		rec.GetInstance(), rec.GetProduct(), rec.GetAddon(), rec.GetResource(), rec.GetStart(), rec.GetEnd())))
+	return hex.EncodeToString(hash[:])
+}
+
+// WithIdempotencyKey puts idempotency key into records meta unless it is already there
+func WithIdempotencyKey(records []*billing.Record) []*billing.Record {
+	for _, rec := range records {
+		if _, ok := rec.GetMeta()["idempotency_key"]; ok {
+			continue
+		}
+		if rec.Meta == nil {
+			rec.Meta = make(map[string]*structpb.Value)
+		}
+		rec.Meta["idempotency_key"] = structpb.NewStringValue(RecordIdempotencyKey(rec))
+	}
+	return records
+}
+
+// ResourceMetered reports whether the resource is billed by the usage reported with report_usage, which is set by metered in resource meta
+func ResourceMetered(res *billing.ResourceConf) bool {
+	return res.GetMeta()["metered"].GetBoolValue()
+}
+
+// ResourceActive reports whether the resource is billed while instance is in the given state.
+// Resource is billed in the states listed in On, or in all the other states if Except is set. Empty On means any state
+func ResourceActive(res *billing.ResourceConf, state states.NoCloudState) bool {
+	if len(res.GetOn()) == 0 {
+		return true
+	}
+	return slices.Contains(res.GetOn(), state) != res.GetExcept()
+}
+
+// StoredAddonPeriod returns addon own period saved in instance data on attach, falling back to the product one
+func StoredAddonPeriod(data map[string]*structpb.Value, addonId string, product *billing.Product) (int64, billing.PeriodKind) {
+	val, ok := data[fmt.Sprintf("addon_%s_period", addonId)]
+	if !ok {
+		return product.GetPeriod(), product.GetPeriodKind()
+	}
+	return int64(val.GetNumberValue()), billing.PeriodKind(data[fmt.Sprintf("addon_%s_period_kind", addonId)].GetNumberValue())
+}
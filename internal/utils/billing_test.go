@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	"github.com/slntopp/nocloud-proto/states"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestResourceMetered(t *testing.T) {
+	metered := &billing.ResourceConf{Meta: map[string]*structpb.Value{"metered": structpb.NewBoolValue(true)}}
+	if !ResourceMetered(metered) {
+		t.Error("resource with metered meta is not metered")
+	}
+	if ResourceMetered(&billing.ResourceConf{Except: true}) {
+		t.Error("resource with except set is metered")
+	}
+}
+
+func TestResourceActive(t *testing.T) {
+	running := []states.NoCloudState{states.NoCloudState_RUNNING}
+	tests := []struct {
+		name   string
+		on     []states.NoCloudState
+		except bool
+		state  states.NoCloudState
+		want   bool
+	}{
+		{"any state", nil, false, states.NoCloudState_SUSPENDED, true},
+		{"any state with except", nil, true, states.NoCloudState_SUSPENDED, true},
+		{"listed state", running, false, states.NoCloudState_RUNNING, true},
+		{"not listed state", running, false, states.NoCloudState_SUSPENDED, false},
+		{"excepted state", running, true, states.NoCloudState_RUNNING, false},
+		{"not excepted state", running, true, states.NoCloudState_SUSPENDED, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &billing.ResourceConf{On: tt.on, Except: tt.except}
+			if got := ResourceActive(res, tt.state); got != tt.want {
+				t.Errorf("ResourceActive(%v, %v, %v) = %v, want %v", tt.on, tt.except, tt.state, got, tt.want)
+			}
+		})
+	}
+}
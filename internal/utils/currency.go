@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// Rates maps "FROM/TO" currency pairs to the exchange rate, e.g. "EUR/USD": 1.08
+type Rates map[string]float64
+
+// LoadRates reads rates from a YAML or JSON file
+func LoadRates(file string) (Rates, error) {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	rates := Rates{}
+	if err = yaml.Unmarshal(body, &rates); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// RatesFromValue reads rates from the struct value, like the one stored in SP secrets
+func RatesFromValue(val *structpb.Value) Rates {
+	rates := Rates{}
+	for pair, rate := range val.GetStructValue().GetFields() {
+		rates[pair] = rate.GetNumberValue()
+	}
+	return rates
+}
+
+// Convert converts amount between currencies. Empty currency means the amount is in the same currency as the other side
+func (r Rates) Convert(amount float64, from string, to string) (float64, error) {
+	if from == to || from == "" || to == "" {
+		return amount, nil
+	}
+	if rate, ok := r[from+"/"+to]; ok {
+		return amount * rate, nil
+	}
+	if rate, ok := r[to+"/"+from]; ok && rate != 0 {
+		return amount / rate, nil
+	}
+	return 0, fmt.Errorf("no exchange rate from %s to %s", from, to)
+}
@@ -1,59 +1,91 @@
 package utils
 
 import (
+	"github.com/slntopp/nocloud-proto/billing"
 	ipb "github.com/slntopp/nocloud-proto/instances"
-	"github.com/slntopp/nocloud/pkg/nocloud/periods"
 	"time"
 )
 
-func AlignPaymentDate(start int64, end int64, period int64, inst *ipb.Instance) int64 {
-	// Apply only on month period
-	if period != 30*86400 {
-		return end
+// calendarMonths returns length in calendar months of the period given in seconds, 0 if the period has fixed length,
+// like days or weeks
+func calendarMonths(period int64) int {
+	if period%86400 != 0 {
+		return 0
 	}
-	// If instance has start date, then apply billing month
-	if start <= end && (inst != nil && inst.GetMeta() != nil && inst.GetMeta().Started > 0) {
-		return periods.GetNextDate(start, periods.BillingMonth, inst.GetMeta().Started)
+	switch days := period / 86400; {
+	case days >= 28 && days <= 31:
+		return 1
+	case days >= 89 && days <= 92:
+		return 3
+	case days >= 181 && days <= 184:
+		return 6
+	case days == 365 || days == 366:
+		return 12
 	}
+	return 0
+}
+
+// addMonths moves t by months to the given day of month, clamped to the month end
+func addMonths(t time.Time, months int, day int) time.Time {
+	year, month, _ := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(day, last)-1)
+}
 
-	daysInMonth := func(year int, month time.Month) int {
-		return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+// anchorDay returns the day of month payment dates are aligned to. It's the day of Meta.Started if set, otherwise the start day.
+// If start was clamped to the month end, e.g. Feb 28 for Jan 31, the day instance was created is used to get back to it
+func anchorDay(start time.Time, inst *ipb.Instance) int {
+	if inst.GetMeta().GetStarted() > 0 {
+		return time.Unix(inst.GetMeta().GetStarted(), 0).UTC().Day()
+	}
+	day := start.Day()
+	if start.AddDate(0, 0, 1).Month() != start.Month() && inst.GetCreated() > 0 {
+		day = max(day, time.Unix(inst.GetCreated(), 0).UTC().Day())
 	}
+	return day
+}
 
-	var sign int
-	if start <= end {
-		sign = 1
-	} else {
-		sign = -1
+// AlignPaymentDate moves end, which is start +/- period, to the same day of month in the next or previous calendar period.
+// Monthly, quarterly, half-year and yearly periods are aligned, other periods have fixed length and are returned as is
+func AlignPaymentDate(start int64, end int64, period int64, inst *ipb.Instance) int64 {
+	months := calendarMonths(period)
+	if months == 0 {
+		return end
+	}
+	if start > end {
+		months = -months
 	}
 
 	startTime := time.Unix(start, 0).In(time.UTC)
-	dayStart := startTime.Day()
-	daysInMonthStart := daysInMonth(startTime.Year(), startTime.Month())
-	endTime := time.Unix(end, 0).In(time.UTC)
+	return addMonths(startTime, months, anchorDay(startTime, inst)).Unix()
+}
 
-	var delta int
-	if sign == 1 {
-		delta = daysInMonthStart - startTime.Day() + 1
-	} else {
-		delta = -(startTime.Day() + 1)
+// NextPaymentDate returns the end of the period starting at start
+func NextPaymentDate(start int64, period int64, kind billing.PeriodKind, inst *ipb.Instance) int64 {
+	end := start + period
+	if kind != billing.PeriodKind_DEFAULT {
+		end = AlignPaymentDate(start, end, period, inst)
 	}
-	yearAfterStartDate := startTime.AddDate(0, 0, delta).Year()
-	monthAfterStartDate := startTime.AddDate(0, 0, delta).Month()
-	daysInMonthEnd := daysInMonth(yearAfterStartDate, monthAfterStartDate)
+	return end
+}
 
-	// Happens when start is 1st day in 31day month
-	if startTime.Month() == endTime.Month() {
-		if sign == 1 {
-			return startTime.AddDate(0, 1*sign, 0).Unix()
-		}
+// PreviousPaymentDate returns the start of the period ending at end
+func PreviousPaymentDate(end int64, period int64, kind billing.PeriodKind, inst *ipb.Instance) int64 {
+	start := end - period
+	if kind != billing.PeriodKind_DEFAULT {
+		start = AlignPaymentDate(end, start, period, inst)
 	}
+	return start
+}
 
-	// Default case, just add month
-	if dayStart <= daysInMonthEnd {
-		return startTime.AddDate(0, 1*sign, 0).Unix()
+// Prorate returns the part of [start, end] period which lies after from, clamped to [0, 1]
+func Prorate(start int64, end int64, from int64) float64 {
+	if end <= start || from >= end {
+		return 0
 	}
-
-	// Overlapping case. Add month and subtract days
-	return startTime.AddDate(0, 1*sign, daysInMonthEnd-dayStart).Unix()
+	if from <= start {
+		return 1
+	}
+	return float64(end-from) / float64(end-start)
 }
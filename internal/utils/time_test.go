@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slntopp/nocloud-proto/billing"
+	ipb "github.com/slntopp/nocloud-proto/instances"
+)
+
+const day = 86400
+
+func date(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 12, 30, 15, 0, time.UTC)
+}
+
+func TestCalendarMonths(t *testing.T) {
+	tests := []struct {
+		period int64
+		months int
+	}{
+		{0, 0},
+		{3600, 0},
+		{day, 0},
+		{7 * day, 0},
+		{27 * day, 0},
+		{28 * day, 1},
+		{30 * day, 1},
+		{31 * day, 1},
+		{32 * day, 0},
+		{30*day + 1, 0},
+		{88 * day, 0},
+		{89 * day, 3},
+		{91 * day, 3},
+		{92 * day, 3},
+		{93 * day, 0},
+		{180 * day, 0},
+		{181 * day, 6},
+		{182 * day, 6},
+		{184 * day, 6},
+		{185 * day, 0},
+		{364 * day, 0},
+		{365 * day, 12},
+		{366 * day, 12},
+		{367 * day, 0},
+	}
+	for _, tt := range tests {
+		if got := calendarMonths(tt.period); got != tt.months {
+			t.Errorf("calendarMonths(%d days) = %d, want %d", tt.period/day, got, tt.months)
+		}
+	}
+}
+
+func TestAddMonths(t *testing.T) {
+	tests := []struct {
+		name   string
+		t      time.Time
+		months int
+		day    int
+		want   time.Time
+	}{
+		{"same day", date(2026, 1, 15), 1, 15, date(2026, 2, 15)},
+		{"clamped to february", date(2026, 1, 31), 1, 31, date(2026, 2, 28)},
+		{"clamped to leap february", date(2024, 1, 31), 1, 31, date(2024, 2, 29)},
+		{"back from clamped", date(2026, 2, 28), 1, 31, date(2026, 3, 31)},
+		{"clamped to 30 days month", date(2026, 3, 31), 1, 31, date(2026, 4, 30)},
+		{"quarter", date(2026, 8, 31), 3, 31, date(2026, 11, 30)},
+		{"half-year", date(2026, 8, 31), 6, 31, date(2027, 2, 28)},
+		{"year over new year", date(2026, 12, 31), 1, 31, date(2027, 1, 31)},
+		{"leap year", date(2024, 2, 29), 12, 29, date(2025, 2, 28)},
+		{"back to leap year", date(2027, 2, 28), 12, 29, date(2028, 2, 29)},
+		{"backwards", date(2026, 3, 31), -1, 31, date(2026, 2, 28)},
+		{"backwards over new year", date(2026, 1, 31), -3, 31, date(2025, 10, 31)},
+		{"backwards year", date(2025, 2, 28), -12, 29, date(2024, 2, 29)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addMonths(tt.t, tt.months, tt.day); !got.Equal(tt.want) {
+				t.Errorf("addMonths(%v, %d, %d) = %v, want %v", tt.t, tt.months, tt.day, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnchorDay(t *testing.T) {
+	tests := []struct {
+		name  string
+		start time.Time
+		inst  *ipb.Instance
+		want  int
+	}{
+		{"no instance", date(2026, 3, 15), nil, 15},
+		{"start day", date(2026, 3, 15), &ipb.Instance{Created: date(2026, 1, 31).Unix()}, 15},
+		{"month end without created", date(2026, 2, 28), &ipb.Instance{}, 28},
+		{"month end restores created day", date(2026, 2, 28), &ipb.Instance{Created: date(2026, 1, 31).Unix()}, 31},
+		{"month end keeps later start day", date(2026, 4, 30), &ipb.Instance{Created: date(2026, 1, 15).Unix()}, 30},
+		{"started", date(2026, 2, 28), &ipb.Instance{
+			Created: date(2026, 1, 10).Unix(),
+			Meta:    &ipb.InstanceMeta{Started: date(2026, 1, 30).Unix()},
+		}, 30},
+		{"started over start day", date(2026, 3, 15), &ipb.Instance{
+			Meta: &ipb.InstanceMeta{Started: date(2026, 1, 5).Unix()},
+		}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := anchorDay(tt.start, tt.inst); got != tt.want {
+				t.Errorf("anchorDay(%v) = %d, want %d", tt.start, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlignPaymentDate(t *testing.T) {
+	created := &ipb.Instance{Created: date(2026, 1, 31).Unix()}
+	leap := &ipb.Instance{Created: date(2024, 2, 29).Unix()}
+	started := &ipb.Instance{
+		Created: date(2026, 1, 3).Unix(),
+		Meta:    &ipb.InstanceMeta{Started: date(2026, 1, 31).Unix()},
+	}
+
+	tests := []struct {
+		name   string
+		start  time.Time
+		period int64
+		inst   *ipb.Instance
+		want   time.Time
+	}{
+		{"monthly", date(2026, 1, 31), 30 * day, created, date(2026, 2, 28)},
+		{"monthly after clamping", date(2026, 2, 28), 30 * day, created, date(2026, 3, 31)},
+		{"monthly 28 days", date(2026, 2, 28), 28 * day, created, date(2026, 3, 31)},
+		{"monthly 31 days", date(2026, 3, 31), 31 * day, created, date(2026, 4, 30)},
+		{"monthly started", date(2026, 2, 28), 30 * day, started, date(2026, 3, 31)},
+		{"quarterly", date(2026, 1, 31), 90 * day, created, date(2026, 4, 30)},
+		{"quarterly after clamping", date(2026, 4, 30), 91 * day, created, date(2026, 7, 31)},
+		{"half-year", date(2026, 8, 31), 182 * day, created, date(2027, 2, 28)},
+		{"yearly 365 days", date(2024, 2, 29), 365 * day, leap, date(2025, 2, 28)},
+		{"yearly 366 days", date(2024, 2, 29), 366 * day, leap, date(2025, 2, 28)},
+		{"yearly back to leap day", date(2027, 2, 28), 365 * day, leap, date(2028, 2, 29)},
+		{"weekly", date(2026, 1, 31), 7 * day, created, date(2026, 2, 7)},
+		{"daily", date(2026, 2, 28), day, created, date(2026, 3, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := tt.start.Unix()
+			got := AlignPaymentDate(start, start+tt.period, tt.period, tt.inst)
+			if got != tt.want.Unix() {
+				t.Errorf("AlignPaymentDate forward = %v, want %v", time.Unix(got, 0).UTC(), tt.want)
+			}
+			if back := AlignPaymentDate(got, got-tt.period, tt.period, tt.inst); back != start {
+				t.Errorf("AlignPaymentDate backward = %v, want %v", time.Unix(back, 0).UTC(), tt.start)
+			}
+		})
+	}
+
+	// Start which isn't on the Started day is moved to it
+	start := date(2026, 3, 15).Unix()
+	if got := AlignPaymentDate(start, start+30*day, 30*day, started); got != date(2026, 4, 30).Unix() {
+		t.Errorf("AlignPaymentDate from unaligned start = %v, want %v", time.Unix(got, 0).UTC(), date(2026, 4, 30))
+	}
+}
+
+func TestPaymentDatesRoundTrip(t *testing.T) {
+	periods := []int64{3600, day, 7 * day, 28 * day, 30 * day, 31 * day, 90 * day, 91 * day, 182 * day, 365 * day, 366 * day}
+	kinds := []billing.PeriodKind{billing.PeriodKind_DEFAULT, billing.PeriodKind_CALENDAR_MONTH}
+
+	for x := date(2023, 1, 1); x.Before(date(2029, 1, 1)); x = x.AddDate(0, 0, 1) {
+		instances := []*ipb.Instance{
+			{Created: x.Unix()},
+			{Meta: &ipb.InstanceMeta{Started: x.Unix()}},
+		}
+		for _, inst := range instances {
+			for _, period := range periods {
+				for _, kind := range kinds {
+					next := NextPaymentDate(x.Unix(), period, kind, inst)
+					if next <= x.Unix() {
+						t.Fatalf("NextPaymentDate(%v, %d, %v) = %v is not after start", x, period, kind, time.Unix(next, 0).UTC())
+					}
+					if prev := PreviousPaymentDate(next, period, kind, inst); prev != x.Unix() {
+						t.Fatalf("PreviousPaymentDate(NextPaymentDate(%v, %d, %v)) = %v", x, period, kind, time.Unix(prev, 0).UTC())
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPaymentDatesChain(t *testing.T) {
+	// Walking forward and back over many periods must return to the same dates
+	for _, x := range []time.Time{date(2024, 1, 31), date(2024, 2, 29), date(2026, 8, 30), date(2026, 5, 31)} {
+		inst := &ipb.Instance{Created: x.Unix()}
+		for _, period := range []int64{30 * day, 91 * day, 182 * day, 365 * day} {
+			dates := []int64{x.Unix()}
+			for n := 0; n < 24; n++ {
+				next := NextPaymentDate(dates[n], period, billing.PeriodKind_CALENDAR_MONTH, inst)
+				if d := time.Unix(next, 0).UTC(); d.Day() != min(x.Day(), d.AddDate(0, 1, -d.Day()).Day()) {
+					t.Fatalf("NextPaymentDate(%v, %d days) drifted to %v", time.Unix(dates[n], 0).UTC(), period/day, d)
+				}
+				dates = append(dates, next)
+			}
+			for n := len(dates) - 1; n > 0; n-- {
+				if prev := PreviousPaymentDate(dates[n], period, billing.PeriodKind_CALENDAR_MONTH, inst); prev != dates[n-1] {
+					t.Fatalf("PreviousPaymentDate(%v, %d days) = %v, want %v", time.Unix(dates[n], 0).UTC(), period/day,
+						time.Unix(prev, 0).UTC(), time.Unix(dates[n-1], 0).UTC())
+				}
+			}
+		}
+	}
+}
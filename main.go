@@ -21,6 +21,7 @@ import (
 	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/slntopp/nocloud-driver-virtual/internal/actions"
 	"github.com/slntopp/nocloud-driver-virtual/internal/server"
+	"github.com/slntopp/nocloud-driver-virtual/internal/utils"
 	"github.com/slntopp/nocloud-proto/ansible"
 	"github.com/slntopp/nocloud-proto/drivers/instance/vanilla"
 	iconnect "github.com/slntopp/nocloud-proto/instances/instancesconnect"
@@ -52,6 +53,8 @@ var (
 	redisHost string
 
 	instancesHost string
+
+	currencyRatesFile string
 )
 
 func init() {
@@ -78,6 +81,9 @@ func init() {
 
 	viper.SetDefault("INSTANCES_HOST", "http://services-registry:8000")
 	instancesHost = viper.GetString("INSTANCES_HOST")
+
+	viper.SetDefault("CURRENCY_RATES_FILE", "")
+	currencyRatesFile = viper.GetString("CURRENCY_RATES_FILE")
 }
 
 // dev
@@ -107,6 +113,15 @@ func main() {
 	s := grpc.NewServer()
 	srv := server.NewVirtualDriver(log, rbmq, rdb, SIGNING_KEY, type_key)
 
+	if currencyRatesFile != "" {
+		log.Info("Loading currency rates", zap.String("file", currencyRatesFile))
+		rates, err := utils.LoadRates(currencyRatesFile)
+		if err != nil {
+			log.Fatal("Failed to load currency rates", zap.Error(err))
+		}
+		srv.SetCurrencyRates(rates)
+	}
+
 	if ansibleHost != "" {
 		log.Info("Ansible host", zap.String("Host", ansibleHost))
 		dial, err := grpc.Dial(ansibleHost, grpc.WithTransportCredentials(insecure.NewCredentials()))